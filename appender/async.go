@@ -3,6 +3,7 @@ package appender
 import (
 	"context"
 	"errors"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,31 +16,88 @@ import (
 // TODO: message structs could be used in general
 type writeMessage struct {
 	// TODO: create a custom []byte buffer instance so we do not need to keep the reference to the pool?
-	buf   *buffer.Buffer
-	ent   zapcore.Entry
-	flush chan struct{}
+	buf       *buffer.Buffer
+	ent       zapcore.Entry
+	flush     chan struct{}
+	receipt   *Receipt       // nil unless written with WriteWithReceipt
+	annotated *buffer.Buffer // written instead of buf if set, e.g. for stale messages
+	seq       uint64         // 0 unless the appender stamps sequence numbers
 }
 
 var ErrAppenderShutdown = errors.New("appender shut down")
 
+// WriteErrorFn handles an error returned by writing p to the primary appender.
+// It is called from the forwarding routine and must not retain p.
+type WriteErrorFn func(err error, p []byte, ent zapcore.Entry)
+
 var _ SynchronizationAwareAppender = &Async{}
 
 type Async struct {
-	// only during construction
+	stats asyncCounters
+
+	// only during construction and Resize, guarded by resizeMu
 	maxQueueLength           int
 	calculateDropThresholdFn func(*Async) (int, error)
+	calculateByteThresholdFn func(*Async) (int64, error)
+	laneConfig               []LevelLane
+	memoryBudget             *MemoryBudget
+	memoryReserved           int64
 
 	// readonly
-	primary           Appender
-	fallback          Appender
-	monitorPeriod     time.Duration
-	fallbackThreshold int
-	syncTimeout       time.Duration
+	primary               Appender
+	fallback              Appender
+	overflow              overflowStrategy
+	spill                 SpillQueue
+	onWriteError          WriteErrorFn
+	writeErrorForward     bool // write the messages the primary failed to write to the fallback
+	spillReplayBackoff    time.Duration
+	maxQueueBytes         int64
+	syncTimeout           time.Duration
+	laneMaxSkips          int
+	batchSize             int
+	batchLinger           time.Duration
+	batcher               BatchAppender // the primary if it accepts batches
+	workerCount           int
+	partitionKeyFn        PartitionKeyFn
+	pool                  *WorkerPool // runs the forwarding and the monitoring instead of own routines
+	maxAge                time.Duration
+	staleAction           staleAction
+	staleAnnotateFn       StaleAnnotateFn
+	clock                 zapcore.Clock
+	sequenced             bool
+	enqueueTimeout        time.Duration
+	enqueueTimeoutForward bool
+	emergency             Appender // nil without an emergency level
+	emergencyLevel        zapcore.Level
+	emergencyDeadline     time.Duration
 
 	// state
-	queueWrite chan writeMessage
-	close      chan struct{}
-	shutdown   int32 // incremented by Shutdown
+	lanes            []*lane      // ordered from the highest to the lowest priority
+	queueLimits      atomic.Value // *queueLimits, replaced by Resize
+	ready            chan struct{}
+	overflowed       chan struct{} // wakes up the monitoring routine
+	bytesFreed       chan struct{}
+	close            chan struct{}
+	forwarding       chan struct{} // closed when the forwarding routine returned
+	shutdown         int32         // incremented by Shutdown
+	emergencyFlushed int32         // set when an emergency entry flushes the queue, reset by Sync and the next enqueued entry
+	writers          [2]int32      // number of Write calls in progress per resize epoch
+	epoch            uint32        // incremented by Resize
+	resizeMu         sync.Mutex
+	unsettled        bool           // Resize returned before the writers of the previous epoch finished, guarded by resizeMu
+	memory           *memoryAccount // nil without a memory budget
+	sequencer        sequencer      // only with sequence numbers
+	batch            batch
+	workQueues       []chan writeMessage // nil without workers
+	inflight         sync.WaitGroup      // messages handed to the workers
+	workersDone      sync.WaitGroup
+	forwardJob       poolJob // only with a pool
+	monitorJob       poolJob // only with a pool
+
+	// only accessed by the forwarding routine, or the turn forwarding for the pool
+	replayAfter       time.Time   // spilled messages are not replayed before
+	replayTimer       *time.Timer // schedules the turn after replayAfter
+	forwardingStopped bool
 }
 
 func NewAsync(primary Appender, options ...AsyncOption) (a *Async, err error) {
@@ -48,12 +106,16 @@ func NewAsync(primary Appender, options ...AsyncOption) (a *Async, err error) {
 	}
 	a = &Async{
 		primary: primary,
+		clock:   zapcore.DefaultClock,
 	}
 
 	AsyncMaxQueueLength(1000).apply(a)
-	AsyncQueueMonitorPeriod(time.Second).apply(a)
+	AsyncSpillReplayBackoff(time.Second).apply(a)
 	AsyncQueueMinFreePercent(.1).apply(a)
 	AsyncOnQueueNearlyFullDropMessages().apply(a)
+	AsyncLaneMaxSkips(8).apply(a)
+	AsyncBatchSize(1).apply(a)
+	AsyncForwardingWorkers(1).apply(a)
 
 	for _, option := range options {
 		err = option.apply(a)
@@ -62,30 +124,111 @@ func NewAsync(primary Appender, options ...AsyncOption) (a *Async, err error) {
 		}
 	}
 
-	a.queueWrite = make(chan writeMessage, a.maxQueueLength)
-	a.fallbackThreshold, err = a.calculateDropThresholdFn(a)
+	if a.fallback == nil {
+		if a.writeErrorForward {
+			return nil, errors.New("forwarding failed writes to the fallback requires a fallback")
+		}
+		if a.enqueueTimeoutForward {
+			return nil, errors.New("forwarding timed out writes to the fallback requires a fallback")
+		}
+		a.fallback = NewDiscard()
+	}
+
+	if a.maxQueueLength == 0 && a.maxQueueBytes > 0 {
+		// bounded by bytes alone
+		a.maxQueueLength = int(a.maxQueueBytes / minQueueMessageBytes)
+	}
+	laneConfig := a.laneConfig
+	if laneConfig == nil {
+		laneConfig = []LevelLane{{MinLevel: zapcore.DebugLevel, Capacity: a.maxQueueLength}}
+	} else {
+		a.maxQueueLength = 0
+		for _, l := range laneConfig {
+			a.maxQueueLength += l.Capacity
+		}
+	}
+	limits, err := a.calculateLimits()
+	if err != nil {
+		return nil, err
+	}
+	a.queueLimits.Store(limits)
+	if a.pool != nil {
+		if a.workerCount > 1 {
+			return nil, errors.New("forwarding workers cannot be combined with a worker pool")
+		}
+		a.batchLinger = 0
+	}
+	if a.sequenced {
+		if err = a.validateSequenced(); err != nil {
+			return nil, err
+		}
+	}
+	// batches do not carry sequence numbers
+	if batcher, ok := primary.(BatchAppender); ok && a.batchSize > 1 && !a.sequenced {
+		a.batcher = batcher
+	}
+	a.ready = make(chan struct{}, 1)
+	a.overflowed = make(chan struct{}, 1)
+	a.initLanes(laneConfig)
+	a.bytesFreed = make(chan struct{}, 1)
 	a.close = make(chan struct{})
+	a.forwarding = make(chan struct{})
+	if a.memoryBudget != nil {
+		a.memory, err = a.memoryBudget.attach(a, a.memoryReserved)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	a.start()
 
-	return a, err
+	return a, nil
 }
 
 func (a *Async) start() {
+	if a.pool != nil {
+		a.initPoolJobs()
+		return
+	}
+	a.startWorkers()
 	go a.forwardWrite()
-	go a.monitorQueueWrite()
+	if a.overflow.evicts() {
+		go a.monitorQueueWrite()
+	}
 }
 
 // the return value n does not work in an async context
+// use WriteWithReceipt to learn whether the entry was delivered
 func (a *Async) Write(p []byte, ent zapcore.Entry) (n int, err error) {
+	return a.write(p, ent, nil)
+}
+
+func (a *Async) write(p []byte, ent zapcore.Entry, receipt *Receipt) (n int, err error) {
+	if a.isEmergency(ent) {
+		return a.writeEmergency(p, ent, receipt)
+	}
+	// Shutdown waits for the writers in progress before it empties the queue,
+	// Resize before it settles the replaced rings
+	writers := a.enterWrite()
+	defer atomic.AddInt32(writers, -1)
 	if atomic.LoadInt32(&a.shutdown) != 0 {
 		err = ErrAppenderShutdown
 		return
 	}
 
+	lane := a.laneFor(ent.Level)
+	nearlyFull := a.nearlyFull(lane) || a.nearlyFullBytes(len(p))
+	if nearlyFull && !a.overflow.admit(ent) {
+		// dropped by the overflow strategy
+		atomic.AddUint64(&a.stats.dropped, 1)
+		receipt.resolve(DeliveryDropped, nil)
+		return len(p), nil
+	}
+
 	msg := writeMessage{
-		buf: bufferpool.Get(),
-		ent: ent,
+		buf:     bufferpool.Get(),
+		ent:     ent,
+		receipt: receipt,
 	}
 
 	n, err = msg.buf.Write(p)
@@ -93,11 +236,93 @@ func (a *Async) Write(p []byte, ent zapcore.Entry) (n int, err error) {
 		return
 	}
 
-	// this might block shortly until the monitoring routine drops messages
-	a.queueWrite <- msg
+	// this might block shortly until the monitoring routine, woken up by the wait, evicts messages
+	w := enqueueWait{closed: a.close, timeout: a.enqueueTimeout}
+	defer w.stop()
+	if err = a.reserveBytes(int64(n), &w); err != nil {
+		msg.buf.Free()
+		return a.enqueueFailed(err, p, ent, receipt)
+	}
+	if a.sequenced {
+		err = a.pushSequenced(lane, msg, &w)
+	} else {
+		err = lane.push(msg, &w)
+	}
+	if err != nil {
+		a.release(msg)
+		return a.enqueueFailed(err, p, ent, receipt)
+	}
+	atomic.AddUint64(&a.stats.enqueued, 1)
+	if a.emergency != nil && atomic.LoadInt32(&a.emergencyFlushed) != 0 {
+		// the queue needs to be drained again
+		atomic.StoreInt32(&a.emergencyFlushed, 0)
+	}
+	a.signalReady()
+	if nearlyFull {
+		// the threshold is crossed, so the monitoring routine evicts right away
+		a.signalOverflow()
+	}
 	return
 }
 
+// enqueueFailed handles a message Write could not enqueue.
+// After ErrEnqueueTimeout the message is written to the fallback if configured so, or dropped otherwise.
+func (a *Async) enqueueFailed(err error, p []byte, ent zapcore.Entry, receipt *Receipt) (int, error) {
+	if err != ErrEnqueueTimeout {
+		return 0, err
+	}
+	if a.enqueueTimeoutForward {
+		atomic.AddUint64(&a.stats.diverted, 1)
+		receipt.resolve(DeliveryDiverted, nil)
+		return a.fallback.Write(p, ent)
+	}
+	atomic.AddUint64(&a.stats.dropped, 1)
+	receipt.resolve(DeliveryDropped, nil)
+	return 0, err
+}
+
+// nearlyFull reports whether enqueueing to lane would leave less free space than the threshold
+// in lane or in the whole queue.
+func (a *Async) nearlyFull(lane *lane) bool {
+	limits := a.limits()
+	return lane.available() <= lane.current().threshold ||
+		limits.maxQueueLength-a.queueDepth() <= limits.fallbackThreshold
+}
+
+// signalOverflow wakes up the monitoring routine.
+func (a *Async) signalOverflow() {
+	if a.pool != nil {
+		if a.overflow.evicts() {
+			a.monitorJob.signal()
+		}
+		return
+	}
+	select {
+	case a.overflowed <- struct{}{}:
+	default:
+	}
+}
+
+// signalReady wakes up the forwarding routine.
+func (a *Async) signalReady() {
+	if a.pool != nil {
+		a.forwardJob.signal()
+		return
+	}
+	select {
+	case a.ready <- struct{}{}:
+	default:
+	}
+}
+
+// payload returns the bytes to write to the primary.
+func (m *writeMessage) payload() []byte {
+	if m.annotated != nil {
+		return m.annotated.Bytes()
+	}
+	return m.buf.Bytes()
+}
+
 func (m *writeMessage) flushMarker() bool {
 	if m.flush == nil {
 		return false
@@ -107,60 +332,156 @@ func (m *writeMessage) flushMarker() bool {
 }
 
 func (a *Async) forwardWrite() {
+	defer close(a.forwarding)
+	// the workers return after the forwarding routine
+	defer a.workersDone.Wait()
 	for {
 		select {
 		case <-a.close:
 			return
-		case msg := <-a.queueWrite:
-			if msg.flushMarker() {
-				continue
+		default:
+		}
+		forwarded, backoff := a.forwardNext()
+		switch {
+		case backoff > 0:
+			select {
+			case <-a.close:
+				return
+			case <-time.After(backoff):
 			}
-			// TODO: handle error
-			_, _ = a.primary.Write(msg.buf.Bytes(), msg.ent)
-			msg.buf.Free()
+		case !forwarded:
+			select {
+			case <-a.close:
+				return
+			case <-a.ready:
+			}
+		}
+	}
+}
+
+// forwardNext forwards the next spilled or queued message.
+// It returns false if there was none, and how long to back off
+// after the primary failed to write a spilled message.
+func (a *Async) forwardNext() (forwarded bool, backoff time.Duration) {
+	if a.spill != nil {
+		if backoff = time.Until(a.replayAfter); backoff > 0 {
+			return false, backoff
+		}
+		if a.replaySpilled() {
+			return true, 0
+		}
+	}
+	msg, ok := a.dequeue()
+	if !ok {
+		return false, 0
+	}
+	switch {
+	case msg.flush != nil:
+		// the messages handed to the workers before the marker must be written first
+		a.inflight.Wait()
+		msg.flushMarker()
+	case a.workQueues != nil:
+		a.dispatch(msg)
+	case a.batcher != nil:
+		a.forwardBatch(&a.batch, a.batcher, msg)
+	default:
+		a.forward(msg)
+	}
+	return true, 0
+}
+
+// forward writes a single message to the primary and releases it.
+func (a *Async) forward(msg writeMessage) {
+	a.stats.observeDepth(a.queueDepth() + 1)
+	a.stats.addWait(msg, a.clock.Now())
+	start := time.Now()
+	_, err := a.writePrimary(msg)
+	a.stats.addPrimaryWrite(time.Since(start))
+	if err != nil {
+		a.writeFailed(err, msg)
+	} else {
+		atomic.AddUint64(&a.stats.delivered, 1)
+		msg.receipt.resolve(DeliveryDelivered, nil)
+	}
+	a.release(msg)
+}
+
+// writeFailed counts a message the primary failed to write, reports it to onWriteError
+// and writes it to the fallback if configured so.
+func (a *Async) writeFailed(err error, msg writeMessage) {
+	atomic.AddUint64(&a.stats.failed, 1)
+	if a.onWriteError != nil {
+		a.onWriteError(err, msg.buf.Bytes(), msg.ent)
+	}
+	if a.writeErrorForward {
+		if a.writeFallback(msg) {
+			atomic.AddUint64(&a.stats.diverted, 1)
+			msg.receipt.resolve(DeliveryDiverted, err)
+		} else {
+			atomic.AddUint64(&a.stats.dropped, 1)
+			msg.receipt.resolve(DeliveryDropped, err)
 		}
+		return
 	}
+	msg.receipt.resolve(DeliveryFailed, err)
 }
 
+// monitorQueueWrite evicts messages whenever a writer crossed the threshold or waits for space.
 func (a *Async) monitorQueueWrite() {
-	ticker := time.NewTicker(a.monitorPeriod)
 	for {
 		select {
-		case <-ticker.C:
+		case <-a.overflowed:
 		case <-a.close:
 			return
 		}
-		available := cap(a.queueWrite) - len(a.queueWrite)
-		toFree := a.fallbackThreshold - available
-		for i := 0; i < toFree; i++ {
-			select {
-			case <-a.close:
-				return
-			case msg := <-a.queueWrite:
-				if msg.flushMarker() {
-					continue
-				}
-				// TODO: drop or Fallback: add messageFullStrategy
-				a.fallback.Write(msg.buf.Bytes(), msg.ent)
-				msg.buf.Free()
-			}
-		}
+		a.relieveOverflow()
+	}
+}
+
+// relieveOverflow evicts messages until the thresholds are restored.
+func (a *Async) relieveOverflow() {
+	depth := a.queueDepth()
+	a.stats.observeDepth(depth)
+	limits := a.limits()
+	toFree := limits.fallbackThreshold - (limits.maxQueueLength - depth)
+	toFreeBytes := a.bytesToFree()
+	// free space in the lanes themselves, as writes to a full lane block
+	for _, l := range a.lanes {
+		freed, freedBytes := a.evict(l, l.current().threshold-l.available(), 0)
+		toFree -= freed
+		toFreeBytes -= freedBytes
 	}
+	// free the remaining space in the whole queue, evicting lower priority messages first
+	a.evictLowestFirst(toFree, toFreeBytes)
 }
 
+// Sync drains the queue and syncs the appenders.
+// Right after an emergency entry flushed the queue, the queue is not drained again,
+// so the Sync that AppenderCore calls for such an entry does not delay the exit.
+// Once another entry is enqueued, Sync drains the queue as usual.
 func (a *Async) Sync() error {
-	ctx := context.Background()
-	if a.syncTimeout != time.Duration(0) {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, a.syncTimeout)
-		defer cancel()
+	if !atomic.CompareAndSwapInt32(&a.emergencyFlushed, 1, 0) {
+		ctx := context.Background()
+		if a.syncTimeout != time.Duration(0) {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, a.syncTimeout)
+			defer cancel()
+		}
+		a.Drain(ctx)
 	}
-	a.Drain(ctx)
-	return multierr.Append(a.primary.Sync(), a.fallback.Sync())
+	err := multierr.Append(a.primary.Sync(), a.fallback.Sync())
+	if a.emergency != nil {
+		err = multierr.Append(err, a.emergency.Sync())
+	}
+	if a.spill != nil {
+		err = multierr.Append(err, a.spill.Sync())
+	}
+	return err
 }
 
 // Drain tries to gracefully drain the remaining buffered messages,
-// blocking until the buffer is empty or the provided context is cancelled.
+// blocking until the buffer is empty, the provided context is cancelled
+// or the appender is shut down.
 func (a *Async) Drain(ctx context.Context) {
 	if ctx == nil {
 		ctx = context.Background()
@@ -171,28 +492,102 @@ func (a *Async) Drain(ctx context.Context) {
 		return
 	default:
 	}
-	// TODO: also we could use Fallback to drain. add to messageFullStrategy interface
-	done := make(chan struct{})
-	msg := writeMessage{
-		flush: done,
+	// TODO: also we could use Fallback to drain. add to overflowStrategy interface
+	// every lane gets a marker as the lanes are forwarded independently
+	markers, ok := a.pushFlushMarkers(ctx)
+	if !ok {
+		return
 	}
-	a.queueWrite <- msg
-	select {
-	case <-ctx.Done(): // we timed out
-	case <-done: // our marker message was handled
+	for _, done := range markers {
+		select {
+		case <-ctx.Done(): // we timed out
+			return
+		case <-a.close: // the forwarding routine is stopped
+			return
+		case <-done: // our marker message was handled
+		}
+	}
+}
+
+// pushFlushMarkers pushes a flush marker to every lane.
+// It returns false if ctx was done or the forwarding routine stopped before.
+func (a *Async) pushFlushMarkers(ctx context.Context) (markers []chan struct{}, ok bool) {
+	// counted like a Write, so Resize does not drop the ring a marker is pushed to
+	writers := a.enterWrite()
+	defer atomic.AddInt32(writers, -1)
+	markers = make([]chan struct{}, len(a.lanes))
+	for i, l := range a.lanes {
+		markers[i] = make(chan struct{})
+		if l.push(writeMessage{flush: markers[i]}, &enqueueWait{done: ctx.Done(), closed: a.close}) != nil {
+			return nil, false
+		}
+		a.signalReady()
 	}
+	return markers, true
 }
 
 func (a *Async) Synchronized() bool {
 	return true
 }
 
-func (a *Async) Shutdown(ctx context.Context) {
+// Shutdown drains the queue until ctx is done and stops the appender.
+// Messages still queued afterwards are written to the fallback.
+// It returns the number of these messages, which were never delivered to the primary appender.
+// Writes after Shutdown return ErrAppenderShutdown.
+// Shutdown waits for the writes in progress until ctx is done;
+// a message a write still in progress enqueues afterwards is not delivered.
+func (a *Async) Shutdown(ctx context.Context) (undelivered int) {
 	if atomic.SwapInt32(&a.shutdown, 1) != 0 {
-		return // already called
+		return 0 // already called
+	}
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
 	a.Drain(ctx)
-	close(a.close) // stop the loops, after draining
-	close(a.queueWrite)
+	close(a.close) // stop the loops and release blocked writers, after draining
+	if a.pool != nil {
+		// the next turn stops forwarding
+		a.forwardJob.signal()
+	}
+
+	// a primary that blocks must not block the shutdown beyond ctx
+	select {
+	case <-a.forwarding:
+	case <-ctx.Done():
+	}
+	// a write blocked by the fallback must not block the shutdown beyond ctx either
+	_ = poll(ctx, a.writesReturned)
+
+	// dispatched before the queued messages
+	undelivered += a.divertDispatched()
+	for _, l := range a.lanes {
+		undelivered += a.divertQueued(l)
+	}
+	if a.memory != nil {
+		a.memory.budget.detach(a.memory)
+	}
+	return undelivered
+}
+
+// writesReturned reports whether no Write is in progress.
+func (a *Async) writesReturned() bool {
+	return atomic.LoadInt32(&a.writers[0]) == 0 && atomic.LoadInt32(&a.writers[1]) == 0
+}
+
+// divertQueued writes all messages queued in l to the fallback.
+// It returns the number of written messages.
+func (a *Async) divertQueued(l *lane) (diverted int) {
+	for {
+		msg, ok := l.pop()
+		if !ok {
+			return diverted
+		}
+		if msg.flushMarker() {
+			continue
+		}
+		a.divert(msg)
+		a.release(msg)
+		diverted++
+	}
 }
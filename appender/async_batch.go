@@ -0,0 +1,117 @@
+package appender
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// batch collects the messages forwarded to a BatchAppender primary in one call.
+// only accessed by the forwarding routine or worker owning it
+type batch struct {
+	msgs   []writeMessage
+	ps     [][]byte
+	ents   []zapcore.Entry
+	linger *time.Timer
+}
+
+func (b *batch) add(msg writeMessage) {
+	b.msgs = append(b.msgs, msg)
+	b.ps = append(b.ps, msg.payload())
+	b.ents = append(b.ents, msg.ent)
+}
+
+// reset empties the batch, keeping the allocated slices.
+func (b *batch) reset() {
+	for i := range b.msgs {
+		b.msgs[i] = writeMessage{}
+		b.ps[i] = nil
+		b.ents[i] = zapcore.Entry{}
+	}
+	b.msgs = b.msgs[:0]
+	b.ps = b.ps[:0]
+	b.ents = b.ents[:0]
+}
+
+func (b *batch) startLinger(d time.Duration) {
+	if b.linger == nil {
+		b.linger = time.NewTimer(d)
+		return
+	}
+	b.linger.Reset(d)
+}
+
+func (b *batch) stopLinger() {
+	if !b.linger.Stop() {
+		<-b.linger.C
+	}
+}
+
+// forwardBatch collects up to batchSize messages starting with msg and writes them to primary in one call.
+// If the queue runs empty, it waits for more messages up to batchLinger.
+// A flush marker ends the batch and is handled after the batch was written.
+func (a *Async) forwardBatch(b *batch, primary BatchAppender, msg writeMessage) {
+	b.add(msg)
+	var marker writeMessage
+	lingering := false
+collect:
+	for len(b.msgs) < a.batchSize {
+		next, ok := a.dequeue()
+		switch {
+		case ok && next.flush != nil:
+			marker = next
+			break collect
+		case ok:
+			b.add(next)
+		case a.batchLinger <= 0:
+			break collect
+		default:
+			if !lingering {
+				b.startLinger(a.batchLinger)
+				lingering = true
+			}
+			select {
+			case <-a.ready:
+			case <-b.linger.C:
+				lingering = false
+				break collect
+			case <-a.close:
+				break collect
+			}
+		}
+	}
+	if lingering {
+		b.stopLinger()
+	}
+
+	a.deliverBatch(b, primary)
+	marker.flushMarker()
+}
+
+// deliverBatch writes the collected batch to primary and releases its messages.
+func (a *Async) deliverBatch(b *batch, primary BatchAppender) {
+	a.stats.observeDepth(a.queueDepth() + len(b.msgs))
+	now := a.clock.Now()
+	for _, msg := range b.msgs {
+		a.stats.addWait(msg, now)
+	}
+	start := time.Now()
+	n, err := primary.WriteBatch(b.ps, b.ents)
+	a.stats.addPrimaryWrite(time.Since(start))
+	if err == nil && n < len(b.msgs) {
+		err = io.ErrShortWrite
+	}
+	atomic.AddUint64(&a.stats.delivered, uint64(n))
+	for _, msg := range b.msgs[:n] {
+		msg.receipt.resolve(DeliveryDelivered, nil)
+	}
+	for _, msg := range b.msgs[n:] {
+		a.writeFailed(err, msg)
+	}
+	for _, msg := range b.msgs {
+		a.release(msg)
+	}
+	b.reset()
+}
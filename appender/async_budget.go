@@ -0,0 +1,102 @@
+package appender
+
+import (
+	"sync/atomic"
+)
+
+// minQueueMessageBytes is the message size the queue is sized for
+// if it is bounded by bytes alone.
+const minQueueMessageBytes = 64
+
+// reserveBytes takes n bytes from the byte budget and the memory budget.
+// It blocks while the queue holds messages and n does not fit in the budgets.
+// It returns the error of w if the wait ends before n fits.
+func (a *Async) reserveBytes(n int64, w *enqueueWait) error {
+	if a.tryReserveBytes(n) {
+		return nil
+	}
+	if a.memory != nil {
+		atomic.AddInt32(&a.memory.budget.waiting, 1)
+		defer atomic.AddInt32(&a.memory.budget.waiting, -1)
+	}
+	for {
+		a.signalOverflow()
+		if err := w.wait(a.bytesFreed); err != nil {
+			return err
+		}
+		if a.tryReserveBytes(n) {
+			if a.maxQueueBytes != 0 && atomic.LoadInt64(&a.stats.queueBytes) < a.maxQueueBytes {
+				// there might be space left for another waiting writer
+				a.signalBytesFreed()
+			}
+			return nil
+		}
+	}
+}
+
+// tryReserveBytes takes n bytes if they fit in the budgets or the queue is empty.
+func (a *Async) tryReserveBytes(n int64) bool {
+	queued := atomic.AddInt64(&a.stats.queueBytes, n)
+	if a.maxQueueBytes != 0 && queued > a.maxQueueBytes && queued != n {
+		atomic.AddInt64(&a.stats.queueBytes, -n)
+		return false
+	}
+	if a.memory != nil && !a.memory.acquire(n) {
+		atomic.AddInt64(&a.stats.queueBytes, -n)
+		return false
+	}
+	return true
+}
+
+// releaseBytes returns n bytes to the byte budget and the memory budget.
+func (a *Async) releaseBytes(n int64) {
+	atomic.AddInt64(&a.stats.queueBytes, -n)
+	if a.memory != nil {
+		a.memory.release(n)
+	}
+	if a.maxQueueBytes != 0 || a.memory != nil {
+		a.signalBytesFreed()
+	}
+}
+
+func (a *Async) signalBytesFreed() {
+	select {
+	case a.bytesFreed <- struct{}{}:
+	default:
+	}
+}
+
+// nearlyFullBytes reports whether enqueueing n bytes would leave less free bytes than the threshold
+// or exceed the memory budget.
+func (a *Async) nearlyFullBytes(n int) bool {
+	if a.memory != nil && !a.memory.fits(int64(n)) {
+		return true
+	}
+	if a.maxQueueBytes == 0 {
+		return false
+	}
+	return a.maxQueueBytes-atomic.LoadInt64(&a.stats.queueBytes)-int64(n) < a.limits().byteThreshold
+}
+
+// bytesToFree returns the number of bytes to evict to restore the byte threshold
+// and to make room in the memory budget.
+func (a *Async) bytesToFree() (toFree int64) {
+	if a.maxQueueBytes != 0 {
+		toFree = a.limits().byteThreshold - (a.maxQueueBytes - atomic.LoadInt64(&a.stats.queueBytes))
+	}
+	if a.memory != nil {
+		if memoryToFree := a.memory.bytesToFree(); memoryToFree > toFree {
+			toFree = memoryToFree
+		}
+	}
+	return toFree
+}
+
+// release returns the budget and the buffer of a message that left the queue.
+func (a *Async) release(msg writeMessage) {
+	a.releaseBytes(int64(msg.buf.Len()))
+	msg.buf.Free()
+	if msg.annotated != nil {
+		msg.annotated.Free()
+	}
+}
@@ -0,0 +1,31 @@
+package appender
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// writeEmergency writes an entry at or above the emergency level to the emergency appender right away
+// and flushes the queue until the emergency deadline, as the process is likely to exit afterwards.
+// The following Sync does not wait for the queue again.
+func (a *Async) writeEmergency(p []byte, ent zapcore.Entry, receipt *Receipt) (n int, err error) {
+	atomic.AddUint64(&a.stats.emergency, 1)
+	n, err = a.emergency.Write(p, ent)
+	_ = a.emergency.Sync()
+	receipt.resolve(DeliveryDiverted, err)
+
+	// set before draining, so an entry enqueued while draining resets it and the next Sync drains again
+	atomic.StoreInt32(&a.emergencyFlushed, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), a.emergencyDeadline)
+	defer cancel()
+	a.Drain(ctx)
+	_ = a.primary.Sync()
+	return n, err
+}
+
+// isEmergency reports whether ent skips the queue.
+func (a *Async) isEmergency(ent zapcore.Entry) bool {
+	return a.emergency != nil && ent.Level >= a.emergencyLevel
+}
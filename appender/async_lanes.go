@@ -0,0 +1,268 @@
+package appender
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// LevelLane configures a queue lane of Async.
+// A lane takes the entries at or above MinLevel that do not belong to a lane with a higher MinLevel.
+// The lane with the lowest MinLevel also takes the entries below its MinLevel.
+type LevelLane struct {
+	MinLevel zapcore.Level
+	Capacity int
+}
+
+// lane is a queue for a band of levels.
+type lane struct {
+	minLevel zapcore.Level
+	// configured is the capacity the lane was configured with.
+	// Resize scales it to the new max queue length.
+	configured int
+	queue      atomic.Value // *laneQueue, replaced by Resize
+	retired    atomic.Value // *retiredRing, nil unless Resize replaced a ring that still holds messages
+	// space is signalled after a pop while writers wait for space
+	space   chan struct{}
+	waiting int32
+	// overflowed is called before a writer waits for space
+	overflowed func()
+	// skipped counts how often the forwarder served a higher lane while this one held entries
+	// only accessed by the forwarding routine
+	skipped int
+}
+
+// laneQueue is the ring of a lane and the free space below which the lane is nearly full.
+type laneQueue struct {
+	ring      *ring
+	threshold int
+}
+
+// retiredRing is a ring replaced by Resize.
+// It is drained before the ring replacing it, so no message is lost or reordered.
+type retiredRing struct {
+	ring *ring
+	// settled is set once no writer pushes to ring anymore
+	settled int32
+}
+
+func newLane(minLevel zapcore.Level, capacity, threshold int, overflowed func()) *lane {
+	l := &lane{
+		minLevel:   minLevel,
+		configured: capacity,
+		space:      make(chan struct{}, 1),
+		overflowed: overflowed,
+	}
+	l.queue.Store(&laneQueue{ring: newRing(capacity), threshold: threshold})
+	l.retired.Store((*retiredRing)(nil))
+	return l
+}
+
+func (l *lane) current() *laneQueue {
+	return l.queue.Load().(*laneQueue)
+}
+
+func (l *lane) retiredRing() *retiredRing {
+	return l.retired.Load().(*retiredRing)
+}
+
+// len returns the number of queued messages, including those of a retired ring.
+func (l *lane) len() int {
+	n := l.current().ring.len()
+	if r := l.retiredRing(); r != nil {
+		n += r.ring.len()
+	}
+	return n
+}
+
+func (l *lane) available() int {
+	return l.current().ring.cap() - l.len()
+}
+
+// pop removes the oldest message and wakes up a writer waiting for space.
+func (l *lane) pop() (msg writeMessage, ok bool) {
+	// load the current ring first: a ring is retired before it is replaced
+	q := l.current()
+	if r := l.retiredRing(); r != nil {
+		if msg, ok = r.ring.pop(); ok {
+			return msg, true
+		}
+		if r.ring.len() != 0 {
+			// a writer is still pushing to the retired ring, its message must be popped first
+			return msg, false
+		}
+		l.dropRetired(r)
+	}
+	msg, ok = q.ring.pop()
+	if ok && atomic.LoadInt32(&l.waiting) != 0 {
+		l.signalSpace()
+	}
+	return msg, ok
+}
+
+// dropRetired forgets r once it is settled and empty. It reports whether r is gone.
+func (l *lane) dropRetired(r *retiredRing) bool {
+	// settled first, a push before settling is counted by len
+	if atomic.LoadInt32(&r.settled) == 0 || r.ring.len() != 0 {
+		return false
+	}
+	l.retired.CompareAndSwap(r, (*retiredRing)(nil))
+	return true
+}
+
+// resize replaces the ring of the lane if its capacity changes and sets the threshold.
+// The replaced ring is retired, so it must be settled before the lane is resized again.
+func (l *lane) resize(capacity, threshold int) {
+	q := l.current()
+	if q.ring.cap() == capacity {
+		l.queue.Store(&laneQueue{ring: q.ring, threshold: threshold})
+		return
+	}
+	l.retired.Store(&retiredRing{ring: q.ring})
+	l.queue.Store(&laneQueue{ring: newRing(capacity), threshold: threshold})
+	// writers waiting for space in the retired ring push to the new one
+	l.signalSpace()
+}
+
+func (l *lane) signalSpace() {
+	select {
+	case l.space <- struct{}{}:
+	default:
+	}
+}
+
+// push appends msg, waiting for space while the lane is full.
+// It returns the error of w without pushing if the wait ends first.
+func (l *lane) push(msg writeMessage, w *enqueueWait) error {
+	return l.pushWith(w, func(r *ring) bool { return r.push(msg) })
+}
+
+// pushWith calls tryPush with the current ring until it pushed, waiting for space in between.
+func (l *lane) pushWith(w *enqueueWait, tryPush func(r *ring) bool) error {
+	if tryPush(l.current().ring) {
+		return nil
+	}
+	atomic.AddInt32(&l.waiting, 1)
+	defer atomic.AddInt32(&l.waiting, -1)
+	for {
+		// retry after announcing the wait, a pop before it did not signal
+		// the ring is loaded again as Resize might have replaced it
+		if tryPush(l.current().ring) {
+			if l.available() > 0 {
+				// there might be space left for another waiting writer
+				l.signalSpace()
+			}
+			return nil
+		}
+		l.overflowed()
+		if err := w.wait(l.space); err != nil {
+			return err
+		}
+	}
+}
+
+func validateLanes(lanes []LevelLane) error {
+	if len(lanes) == 0 {
+		return errors.New("at least one lane is required")
+	}
+	levels := make(map[zapcore.Level]struct{}, len(lanes))
+	for _, l := range lanes {
+		if l.Capacity <= 0 {
+			return errors.New("lane capacity must be positive")
+		}
+		if _, ok := levels[l.MinLevel]; ok {
+			return errors.New("lanes must have distinct levels")
+		}
+		levels[l.MinLevel] = struct{}{}
+	}
+	return nil
+}
+
+// initLanes creates the lanes ordered from the highest to the lowest priority.
+// The threshold is shared proportionally to the lane capacities.
+func (a *Async) initLanes(config []LevelLane) {
+	config = append([]LevelLane(nil), config...)
+	sort.Slice(config, func(i, j int) bool { return config[i].MinLevel > config[j].MinLevel })
+
+	limits := a.limits()
+	a.lanes = make([]*lane, len(config))
+	for i, c := range config {
+		a.lanes[i] = newLane(c.MinLevel, c.Capacity, limits.laneThreshold(c.Capacity), a.signalOverflow)
+	}
+}
+
+// laneFor returns the lane for entries with level.
+func (a *Async) laneFor(level zapcore.Level) *lane {
+	for _, l := range a.lanes {
+		if level >= l.minLevel {
+			return l
+		}
+	}
+	return a.lanes[len(a.lanes)-1]
+}
+
+// queueDepth returns the number of queued messages of all lanes.
+func (a *Async) queueDepth() (depth int) {
+	for _, l := range a.lanes {
+		depth += l.len()
+	}
+	return depth
+}
+
+// nextMessage returns the next queued message without blocking.
+// Higher lanes are favoured, but a lane that was skipped laneMaxSkips times
+// while holding entries is served next.
+func (a *Async) nextMessage() (msg writeMessage, ok bool) {
+	for _, l := range a.lanes {
+		if l.skipped < a.laneMaxSkips {
+			continue
+		}
+		l.skipped = 0
+		if msg, ok = l.pop(); ok {
+			return msg, true
+		}
+	}
+	for i, l := range a.lanes {
+		if msg, ok = l.pop(); ok {
+			for _, lower := range a.lanes[i+1:] {
+				if lower.len() > 0 {
+					lower.skipped++
+				}
+			}
+			return msg, true
+		}
+	}
+	return msg, false
+}
+
+// evictLowestFirst evicts at least toFree messages and toFreeBytes bytes starting with the lowest lane.
+func (a *Async) evictLowestFirst(toFree int, toFreeBytes int64) {
+	for i := len(a.lanes) - 1; i >= 0 && (toFree > 0 || toFreeBytes > 0); i-- {
+		freed, freedBytes := a.evict(a.lanes[i], toFree, toFreeBytes)
+		toFree -= freed
+		toFreeBytes -= freedBytes
+	}
+}
+
+// evict removes messages from the head of l and hands them to the overflow strategy
+// until at least toFree messages and toFreeBytes bytes are removed or l is empty.
+// It returns the number of removed messages and bytes.
+func (a *Async) evict(l *lane, toFree int, toFreeBytes int64) (freed int, freedBytes int64) {
+	for freed < toFree || freedBytes < toFreeBytes {
+		msg, ok := l.pop()
+		if !ok {
+			return freed, freedBytes
+		}
+		freed++
+		if msg.flushMarker() {
+			continue
+		}
+		freedBytes += int64(msg.buf.Len())
+		a.stats.addWait(msg, a.clock.Now())
+		a.overflow.evict(a, msg)
+		a.release(msg)
+	}
+	return freed, freedBytes
+}
@@ -0,0 +1,159 @@
+package appender
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryBudget is a ceiling on the bytes queued by several Async appenders together.
+// Every appender attached with AsyncMemoryBudget owns a reservation no other appender can use;
+// the remaining bytes are shared by all of them.
+// An appender that exceeds its reservation while the shared bytes are used up
+// is nearly full and handles its messages with its overflow strategy,
+// so a noisy appender cannot starve the others.
+type MemoryBudget struct {
+	// updated atomically, first to keep them aligned on 32-bit platforms
+	reserved   int64 // sum of the reservations
+	sharedUsed int64 // bytes used beyond the reservations
+	waiting    int32 // writers waiting for bytes
+
+	max int64
+
+	mu       sync.Mutex
+	accounts map[*memoryAccount]struct{}
+}
+
+// NewMemoryBudget creates a budget of maxBytes.
+func NewMemoryBudget(maxBytes int64) (*MemoryBudget, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("maxBytes must be positive")
+	}
+	return &MemoryBudget{
+		max:      maxBytes,
+		accounts: make(map[*memoryAccount]struct{}),
+	}, nil
+}
+
+// Used returns the number of bytes queued by all attached appenders.
+func (b *MemoryBudget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var used int64
+	for account := range b.accounts {
+		used += atomic.LoadInt64(&account.used)
+	}
+	return used
+}
+
+// sharedFree returns the number of shared bytes not in use.
+func (b *MemoryBudget) sharedFree() int64 {
+	return b.max - atomic.LoadInt64(&b.reserved) - atomic.LoadInt64(&b.sharedUsed)
+}
+
+// attach opens an account for a with reserved bytes.
+func (b *MemoryBudget) attach(a *Async, reserved int64) (*memoryAccount, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if atomic.LoadInt64(&b.reserved)+atomic.LoadInt64(&b.sharedUsed)+reserved > b.max {
+		return nil, errors.New("reservation exceeds the free memory budget")
+	}
+	account := &memoryAccount{budget: b, reserved: reserved, async: a}
+	atomic.AddInt64(&b.reserved, reserved)
+	b.accounts[account] = struct{}{}
+	return account, nil
+}
+
+// detach closes account and returns its reservation to the shared bytes.
+func (b *MemoryBudget) detach(account *memoryAccount) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.accounts, account)
+	atomic.AddInt64(&b.reserved, -account.reserved)
+	b.wakeLocked()
+}
+
+// wake signals the attached appenders that bytes were freed, if any writer waits for them.
+func (b *MemoryBudget) wake() {
+	if atomic.LoadInt32(&b.waiting) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.wakeLocked()
+}
+
+func (b *MemoryBudget) wakeLocked() {
+	for account := range b.accounts {
+		account.async.signalBytesFreed()
+	}
+}
+
+// memoryAccount counts the bytes an Async appender takes from a MemoryBudget.
+// The bytes exceeding the reservation are taken from the shared bytes.
+type memoryAccount struct {
+	used     int64 // updated atomically, first to keep it aligned on 32-bit platforms
+	reserved int64
+	budget   *MemoryBudget
+	async    *Async
+}
+
+// beyondReservation returns the part of used taken from the shared bytes.
+func (m *memoryAccount) beyondReservation(used int64) int64 {
+	if used <= m.reserved {
+		return 0
+	}
+	return used - m.reserved
+}
+
+// add changes used by n and the shared bytes by the change beyond the reservation.
+// As every change is derived from its own result of used, the shared bytes stay exact
+// under concurrent changes.
+// It returns the new used bytes and whether the shared bytes exceed the budget.
+func (m *memoryAccount) add(n int64) (used int64, exceeded bool) {
+	used = atomic.AddInt64(&m.used, n)
+	shared := m.beyondReservation(used) - m.beyondReservation(used-n)
+	if shared == 0 {
+		return used, false
+	}
+	sharedUsed := atomic.AddInt64(&m.budget.sharedUsed, shared)
+	if shared < 0 {
+		m.budget.wake()
+	}
+	return used, sharedUsed > m.budget.max-atomic.LoadInt64(&m.budget.reserved)
+}
+
+// acquire takes n bytes. It fails if they exceed the reservation and the free shared bytes,
+// unless the account is empty, so a message larger than the budget is not blocked forever.
+func (m *memoryAccount) acquire(n int64) bool {
+	used, exceeded := m.add(n)
+	if exceeded && used != n {
+		m.add(-n)
+		return false
+	}
+	return true
+}
+
+func (m *memoryAccount) release(n int64) {
+	m.add(-n)
+}
+
+// fits reports whether n bytes can be acquired without exceeding the budget.
+func (m *memoryAccount) fits(n int64) bool {
+	free := m.reserved - atomic.LoadInt64(&m.used)
+	if free < 0 {
+		free = 0
+	}
+	return n <= free+m.budget.sharedFree()
+}
+
+// bytesToFree returns the number of bytes to evict to leave room for a message
+// in the shared bytes, but no more than the account takes from them.
+func (m *memoryAccount) bytesToFree() int64 {
+	beyond := m.beyondReservation(atomic.LoadInt64(&m.used))
+	toFree := minQueueMessageBytes - m.budget.sharedFree()
+	if toFree > beyond {
+		return beyond
+	}
+	return toFree
+}
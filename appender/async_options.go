@@ -3,6 +3,8 @@ package appender
 import (
 	"errors"
 	"time"
+
+	"go.uber.org/zap/zapcore"
 )
 
 type AsyncOption interface {
@@ -15,6 +17,21 @@ func (f asyncOptionsFunc) apply(a *Async) error {
 	return f(a)
 }
 
+// AsyncThresholdOption sets the free space below which the queue is nearly full.
+// Unlike the other options, it can be passed to Async.Resize.
+type AsyncThresholdOption interface {
+	AsyncOption
+	threshold()
+}
+
+type asyncThresholdFunc func(*Async) error
+
+func (f asyncThresholdFunc) apply(a *Async) error {
+	return f(a)
+}
+
+func (asyncThresholdFunc) threshold() {}
+
 func AsyncMaxQueueLength(length int) AsyncOption {
 	return asyncOptionsFunc(func(a *Async) error {
 		if length < 0 {
@@ -25,9 +42,177 @@ func AsyncMaxQueueLength(length int) AsyncOption {
 	})
 }
 
-// AsyncOnQueueNearlyFullForwardTo
+// AsyncLevelLanes queues messages in separate lanes per level band, each with its own capacity.
+// The max queue length is the sum of the lane capacities and replaces AsyncMaxQueueLength.
+// When the queue is nearly full, the messages of the lowest lanes are evicted first.
+func AsyncLevelLanes(lanes ...LevelLane) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if err := validateLanes(lanes); err != nil {
+			return err
+		}
+		async.laneConfig = lanes
+		return nil
+	})
+}
+
+// AsyncLaneMaxSkips limits how often the forwarding routine favours higher lanes
+// over a lower lane holding messages, before it serves the lower lane.
+func AsyncLaneMaxSkips(maxSkips int) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if maxSkips <= 0 {
+			return errors.New("maxSkips must be positive")
+		}
+		async.laneMaxSkips = maxSkips
+		return nil
+	})
+}
+
+// AsyncBatchSize sets the max number of messages forwarded in one call
+// if the primary appender is a BatchAppender.
+// By default, the size is 1, which disables batching.
+func AsyncBatchSize(size int) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if size <= 0 {
+			return errors.New("size must be positive")
+		}
+		async.batchSize = size
+		return nil
+	})
+}
+
+// AsyncBatchLinger sets how long the forwarding routine waits for more messages
+// before it forwards a batch smaller than AsyncBatchSize. It has no effect unless batching is enabled.
+// By default, a batch holds the messages queued at the time and is forwarded without waiting.
+// With AsyncForwardingWorkers, Drain waits up to linger for the batches the workers collect.
+func AsyncBatchLinger(linger time.Duration) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if linger < 0 {
+			return errors.New("linger must not be negative")
+		}
+		async.batchLinger = linger
+		return nil
+	})
+}
+
+// AsyncForwardingWorkers writes to the primary appender from n workers in parallel.
+// The primary appender must be safe for concurrent writes.
+// The entries are written in no particular order.
+func AsyncForwardingWorkers(n int) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if n <= 0 {
+			return errors.New("n must be positive")
+		}
+		async.workerCount = n
+		async.partitionKeyFn = nil
+		return nil
+	})
+}
+
+// AsyncForwardingWorkersByKey writes to the primary appender from n workers in parallel.
+// The primary appender must be safe for concurrent writes.
+// Entries with the same key are written by the same worker in queue order,
+// so a slow write delays the entries of the keys sharing its worker.
+// Every worker buffers up to 64 entries; the entries of the other workers are only delayed
+// once the buffer of the slow worker is full.
+func AsyncForwardingWorkersByKey(n int, keyFn PartitionKeyFn) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if n <= 0 {
+			return errors.New("n must be positive")
+		}
+		if keyFn == nil {
+			return errors.New("keyFn must not be nil")
+		}
+		async.workerCount = n
+		async.partitionKeyFn = keyFn
+		return nil
+	})
+}
+
+// AsyncOnStaleDrop drops the entries whose Entry.Time is older than maxAge
+// when they are dequeued or replayed from the spill queue.
+func AsyncOnStaleDrop(maxAge time.Duration) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		return async.setMaxAge(maxAge, staleDrop, nil)
+	})
+}
+
+// AsyncOnStaleForwardToFallback writes the entries whose Entry.Time is older than maxAge
+// when they are dequeued or replayed from the spill queue to the fallback instead of the primary appender.
+func AsyncOnStaleForwardToFallback(maxAge time.Duration) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		return async.setMaxAge(maxAge, staleForward, nil)
+	})
+}
+
+// AsyncOnStaleAnnotate writes the entries whose Entry.Time is older than maxAge
+// when they are dequeued or replayed from the spill queue to the primary appender as annotated by fn.
+// If fn fails, the entry is written as is.
+func AsyncOnStaleAnnotate(maxAge time.Duration, fn StaleAnnotateFn) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if fn == nil {
+			return errors.New("fn must not be nil")
+		}
+		return async.setMaxAge(maxAge, staleAnnotate, fn)
+	})
+}
+
+func (a *Async) setMaxAge(maxAge time.Duration, action staleAction, fn StaleAnnotateFn) error {
+	if maxAge <= 0 {
+		return errors.New("maxAge must be positive")
+	}
+	a.maxAge = maxAge
+	a.staleAction = action
+	a.staleAnnotateFn = fn
+	return nil
+}
+
+// AsyncClock sets the clock the age of the entries and their wait in Stats are measured with.
+func AsyncClock(clock zapcore.Clock) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if clock == nil {
+			return errors.New("clock must not be nil")
+		}
+		async.clock = clock
+		return nil
+	})
+}
+
+// AsyncSequenceNumbers stamps the entries with monotonic sequence numbers in the order they are enqueued.
+// Appenders implementing SequencedAppender receive them, e.g. an Enveloping created with NewSequencedEnveloping.
+//
+// Neither the primary appender nor the fallback receive their entries out of order.
+// An entry whose write to the fallback would break the order,
+// e.g. one the primary failed to write after later entries were evicted to the fallback,
+// is dropped and counted as OutOfOrder.
+// As the order of the entries must not change in the queue,
+// it cannot be combined with AsyncLevelLanes, AsyncForwardingWorkers, AsyncOnQueueNearlyFullSpillTo
+// and AsyncOnEnqueueTimeoutForwardToFallback, and batches are not forwarded.
+func AsyncSequenceNumbers() AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		async.sequenced = true
+		return nil
+	})
+}
+
+// AsyncWorkerPool forwards and monitors the queue on the goroutines of pool
+// instead of starting routines for this appender.
+// It cannot be combined with AsyncForwardingWorkers, and batches do not linger
+// as a turn on the pool does not wait for more messages.
+// A write blocked in the primary appender holds a goroutine of pool until it returns.
+func AsyncWorkerPool(pool *WorkerPool) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if pool == nil {
+			return errors.New("pool is required")
+		}
+		async.pool = pool
+		return nil
+	})
+}
+
+// AsyncFallback sets the appender messages are written to instead of the primary appender,
+// e.g. with AsyncOnWriteErrorForwardToFallback. The overflow strategy is not changed.
 // fallback is wrapped in a Synchronizing appender.
-func AsyncOnQueueNearlyFullForwardTo(fallback Appender) AsyncOption {
+func AsyncFallback(fallback Appender) AsyncOption {
 	return asyncOptionsFunc(func(async *Async) error {
 		if fallback == nil {
 			return errors.New("fallback must not be nil")
@@ -37,28 +222,196 @@ func AsyncOnQueueNearlyFullForwardTo(fallback Appender) AsyncOption {
 	})
 }
 
+// AsyncOnQueueNearlyFullForwardTo forwards the oldest queued messages to fallback,
+// which it sets like AsyncFallback.
+func AsyncOnQueueNearlyFullForwardTo(fallback Appender) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if err := AsyncFallback(fallback).apply(async); err != nil {
+			return err
+		}
+		async.overflow = overflowForward{}
+		return nil
+	})
+}
+
+// AsyncOnQueueNearlyFullSpillTo pushes the oldest queued messages to spill.
+// Spilled messages are replayed in order before the queued ones once the primary accepts writes again.
+// Messages spill rejects, e.g. because it is full, are forwarded to the fallback
+// set with AsyncFallback or dropped otherwise.
+func AsyncOnQueueNearlyFullSpillTo(spill SpillQueue) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if spill == nil {
+			return errors.New("spill must not be nil")
+		}
+		async.spill = spill
+		async.overflow = overflowSpill{}
+		return nil
+	})
+}
+
+// AsyncOnQueueNearlyFull handles the entries with strategy once the queue is nearly full.
+func AsyncOnQueueNearlyFull(strategy OverflowStrategy) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if strategy == nil {
+			return errors.New("strategy must not be nil")
+		}
+		async.overflow = overflowCustom{strategy: strategy}
+		return nil
+	})
+}
+
+// AsyncOnQueueNearlyFullDropMessages drops the oldest queued messages.
+// It is the same as AsyncOnQueueNearlyFullDropOldest.
 func AsyncOnQueueNearlyFullDropMessages() AsyncOption {
+	return AsyncOnQueueNearlyFullDropOldest()
+}
+
+// AsyncOnQueueNearlyFullDropOldest drops the oldest queued messages.
+func AsyncOnQueueNearlyFullDropOldest() AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		async.overflow = overflowDropOldest{}
+		return nil
+	})
+}
+
+// AsyncOnQueueNearlyFullDropNewest drops new messages instead of enqueueing them.
+func AsyncOnQueueNearlyFullDropNewest() AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		async.overflow = overflowDropNewest{}
+		return nil
+	})
+}
+
+// AsyncOnQueueNearlyFullBlock keeps all messages.
+// Write blocks the caller until the queue has space again.
+func AsyncOnQueueNearlyFullBlock() AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		async.overflow = overflowBlock{}
+		return nil
+	})
+}
+
+// AsyncOnQueueNearlyFullDropBelow drops new messages with a level below level.
+// Messages at or above level are enqueued, blocking the caller while the queue is full.
+func AsyncOnQueueNearlyFullDropBelow(level zapcore.Level) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		async.overflow = overflowDropBelow{level: level}
+		return nil
+	})
+}
+
+// AsyncOnWriteError calls fn with every error returned by the primary appender.
+// Combined with AsyncOnWriteErrorForwardToFallback, fn is called before the message is forwarded.
+func AsyncOnWriteError(fn WriteErrorFn) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if fn == nil {
+			return errors.New("fn must not be nil")
+		}
+		async.onWriteError = fn
+		return nil
+	})
+}
+
+// AsyncOnWriteErrorForwardToFallback writes messages the primary appender failed to write
+// to the fallback set with AsyncFallback. NewAsync fails without a fallback.
+func AsyncOnWriteErrorForwardToFallback() AsyncOption {
 	return asyncOptionsFunc(func(async *Async) error {
-		async.fallback = NewDiscard()
+		async.writeErrorForward = true
+		return nil
+	})
+}
+
+// AsyncEnqueueTimeout bounds how long Write waits for space in the queue.
+// After the timeout, Write drops the message and returns ErrEnqueueTimeout,
+// unless AsyncOnEnqueueTimeoutForwardToFallback is set.
+func AsyncEnqueueTimeout(timeout time.Duration) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		async.enqueueTimeout = timeout
 		return nil
 	})
 }
 
-func AsyncQueueMinFreePercent(minFreePercent float32) AsyncOption {
+// AsyncOnEnqueueTimeoutForwardToFallback writes messages that were not enqueued within AsyncEnqueueTimeout
+// synchronously to the fallback set with AsyncFallback. NewAsync fails without a fallback.
+func AsyncOnEnqueueTimeoutForwardToFallback() AsyncOption {
 	return asyncOptionsFunc(func(async *Async) error {
+		async.enqueueTimeoutForward = true
+		return nil
+	})
+}
+
+// AsyncMaxQueueBytes bounds the queue by the total bytes of the queued messages
+// in addition to AsyncMaxQueueLength. Write blocks while a message does not fit.
+// Combined with AsyncMaxQueueLength(0) the queue is bounded by bytes alone;
+// it then has room for maxBytes/64 messages.
+func AsyncMaxQueueBytes(maxBytes int64) AsyncOption {
+	return asyncOptionsFunc(func(a *Async) error {
+		if maxBytes <= 0 {
+			return errors.New("maxBytes must be positive")
+		}
+		a.maxQueueBytes = maxBytes
+		return nil
+	})
+}
+
+// AsyncMemoryBudget attaches the appender to budget, shared with other Async appenders,
+// with reservedBytes only this appender can use.
+// Creating the appender fails if the reservation does not fit in the budget.
+// Shutdown returns the reservation to the budget.
+func AsyncMemoryBudget(budget *MemoryBudget, reservedBytes int64) AsyncOption {
+	return asyncOptionsFunc(func(a *Async) error {
+		if budget == nil {
+			return errors.New("budget is required")
+		}
+		if reservedBytes < 0 {
+			return errors.New("reservedBytes must not be negative")
+		}
+		a.memoryBudget = budget
+		a.memoryReserved = reservedBytes
+		return nil
+	})
+}
+
+// AsyncQueueMinFreePercent sets the free space below which the queue is nearly full
+// as a share of AsyncMaxQueueLength and AsyncMaxQueueBytes.
+func AsyncQueueMinFreePercent(minFreePercent float32) AsyncThresholdOption {
+	return asyncThresholdFunc(func(async *Async) error {
 		if minFreePercent < 0 || minFreePercent >= 1 {
 			return errors.New("minFreePercent must be between 0 and 1")
 		}
 		async.calculateDropThresholdFn = func(a *Async) (int, error) {
-			threshold := float32(async.maxQueueLength) * minFreePercent
+			threshold := float32(a.maxQueueLength) * minFreePercent
 			return int(threshold), nil
 		}
+		async.calculateByteThresholdFn = func(a *Async) (int64, error) {
+			threshold := float64(a.maxQueueBytes) * float64(minFreePercent)
+			return int64(threshold), nil
+		}
 		return nil
 	})
 }
 
-func AsyncQueueMinFreeItems(minFree int) AsyncOption {
-	return asyncOptionsFunc(func(async *Async) error {
+// AsyncQueueMinFreeBytes sets the free bytes below which the queue is nearly full.
+func AsyncQueueMinFreeBytes(minFree int64) AsyncThresholdOption {
+	return asyncThresholdFunc(func(async *Async) error {
+		async.calculateByteThresholdFn = func(a *Async) (int64, error) {
+			if minFree < 0 {
+				return 0, errors.New("minFree must be gt 0")
+			}
+			if a.maxQueueBytes < minFree {
+				return 0, errors.New("minFree must less than the max queue bytes")
+			}
+			return minFree, nil
+		}
+		return nil
+	})
+}
+
+func AsyncQueueMinFreeItems(minFree int) AsyncThresholdOption {
+	return asyncThresholdFunc(func(async *Async) error {
 		async.calculateDropThresholdFn = func(a *Async) (int, error) {
 			if minFree < 0 {
 				return 0, errors.New("minFree must be gt 0")
@@ -72,12 +425,51 @@ func AsyncQueueMinFreeItems(minFree int) AsyncOption {
 	})
 }
 
+// AsyncQueueMonitorPeriod validates period and has no effect otherwise.
+//
+// Deprecated: the queue is monitored as soon as it is nearly full.
+// Use AsyncSpillReplayBackoff to set how long the replay of spilled messages backs off.
 func AsyncQueueMonitorPeriod(period time.Duration) AsyncOption {
 	return asyncOptionsFunc(func(async *Async) error {
 		if period <= time.Duration(0) {
 			return errors.New("period must be positive")
 		}
-		async.monitorPeriod = period
+		return nil
+	})
+}
+
+// AsyncSpillReplayBackoff sets how long the replay of spilled messages backs off
+// after the primary appender failed. It defaults to a second.
+func AsyncSpillReplayBackoff(backoff time.Duration) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if backoff <= 0 {
+			return errors.New("backoff must be positive")
+		}
+		async.spillReplayBackoff = backoff
+		return nil
+	})
+}
+
+// AsyncEmergency writes the entries at or above level synchronously to emergency, e.g. stderr,
+// instead of queueing them. Then the queued entries are flushed for at most deadline,
+// so a fatal entry is not lost behind the queue and the exit is not delayed indefinitely.
+// level must be above error, as AppenderCore only syncs such entries,
+// and the Sync following an emergency entry does not wait for the queue again.
+// emergency is wrapped in a Synchronizing appender.
+func AsyncEmergency(level zapcore.Level, emergency Appender, deadline time.Duration) AsyncOption {
+	return asyncOptionsFunc(func(async *Async) error {
+		if level <= zapcore.ErrorLevel {
+			return errors.New("level must be above error")
+		}
+		if emergency == nil {
+			return errors.New("emergency must not be nil")
+		}
+		if deadline <= 0 {
+			return errors.New("deadline must be positive")
+		}
+		async.emergency = NewSynchronizing(emergency)
+		async.emergencyLevel = level
+		async.emergencyDeadline = deadline
 		return nil
 	})
 }
@@ -25,9 +25,146 @@ func TestNewAsync(t *testing.T) {
 			options:    AsyncOptions{AsyncOnQueueNearlyFullForwardTo(NewWriter(zapcore.AddSync(io.Discard)))},
 			assertions: []assertFn{func(a *Async) bool { return Synchronized(a) }},
 		},
+		{name: "on write error nil fn", wantErr: true, options: AsyncOptions{AsyncOnWriteError(nil)}},
+		{name: "level lanes none", wantErr: true, options: AsyncOptions{AsyncLevelLanes()}},
+		{name: "level lanes zero capacity", wantErr: true, options: AsyncOptions{
+			AsyncLevelLanes(LevelLane{MinLevel: zapcore.InfoLevel, Capacity: 0})}},
+		{name: "level lanes same level", wantErr: true, options: AsyncOptions{
+			AsyncLevelLanes(
+				LevelLane{MinLevel: zapcore.InfoLevel, Capacity: 1},
+				LevelLane{MinLevel: zapcore.InfoLevel, Capacity: 1},
+			)}},
+		{name: "level lanes sum capacities",
+			options: AsyncOptions{
+				AsyncLevelLanes(
+					LevelLane{MinLevel: zapcore.DebugLevel, Capacity: 80},
+					LevelLane{MinLevel: zapcore.ErrorLevel, Capacity: 20},
+				),
+				AsyncQueueMinFreePercent(0.1),
+			},
+			assertions: []assertFn{func(a *Async) bool {
+				return a.maxQueueLength == 100 && a.limits().fallbackThreshold == 10 &&
+					a.lanes[0].minLevel == zapcore.ErrorLevel && a.lanes[0].current().threshold == 2 &&
+					a.lanes[1].minLevel == zapcore.DebugLevel && a.lanes[1].current().threshold == 8
+			}},
+		},
+		{name: "lane max skips zero", wantErr: true, options: AsyncOptions{AsyncLaneMaxSkips(0)}},
+		{name: "batch size zero", wantErr: true, options: AsyncOptions{AsyncBatchSize(0)}},
+		{name: "batch linger negative", wantErr: true, options: AsyncOptions{AsyncBatchLinger(-time.Second)}},
+		{name: "batching disabled by default",
+			assertions: []assertFn{func(a *Async) bool { return a.batcher == nil && a.batchSize == 1 }},
+		},
+		{name: "batch appender detected",
+			options:    AsyncOptions{AsyncBatchSize(64)},
+			assertions: []assertFn{func(a *Async) bool { return a.batcher != nil && a.batchSize == 64 }},
+		},
+		{name: "batch size one disables batching",
+			options:    AsyncOptions{AsyncBatchSize(1)},
+			assertions: []assertFn{func(a *Async) bool { return a.batcher == nil }},
+		},
+		{name: "forwarding workers zero", wantErr: true, options: AsyncOptions{AsyncForwardingWorkers(0)}},
+		{name: "forwarding workers by key nil fn", wantErr: true, options: AsyncOptions{AsyncForwardingWorkersByKey(2, nil)}},
+		{name: "forwarding workers by key",
+			options: AsyncOptions{AsyncForwardingWorkersByKey(3, PartitionByLoggerName)},
+			assertions: []assertFn{func(a *Async) bool {
+				return len(a.workQueues) == 3 && a.partitionKeyFn != nil
+			}},
+		},
+		{name: "forwarding workers share a queue",
+			options:    AsyncOptions{AsyncForwardingWorkers(3)},
+			assertions: []assertFn{func(a *Async) bool { return len(a.workQueues) == 1 }},
+		},
+		{name: "worker pool nil", wantErr: true, options: AsyncOptions{AsyncWorkerPool(nil)}},
+		{name: "worker pool with forwarding workers", wantErr: true, options: AsyncOptions{
+			AsyncWorkerPool(&WorkerPool{}), AsyncForwardingWorkers(2)}},
+		{name: "worker pool disables linger",
+			options: AsyncOptions{AsyncWorkerPool(&WorkerPool{}), AsyncBatchLinger(time.Second)},
+			assertions: []assertFn{func(a *Async) bool {
+				return a.pool != nil && a.batchLinger == 0 && a.forwardJob.pool == a.pool
+			}},
+		},
+		{name: "stale max age zero", wantErr: true, options: AsyncOptions{AsyncOnStaleDrop(0)}},
+		{name: "stale annotate nil fn", wantErr: true, options: AsyncOptions{AsyncOnStaleAnnotate(time.Minute, nil)}},
+		{name: "stale forward to fallback",
+			options: AsyncOptions{AsyncOnStaleForwardToFallback(time.Minute)},
+			assertions: []assertFn{func(a *Async) bool {
+				return a.maxAge == time.Minute && a.staleAction == staleForward && a.clock == zapcore.DefaultClock
+			}},
+		},
+		{name: "write error forward without fallback", wantErr: true, options: AsyncOptions{AsyncOnWriteErrorForwardToFallback()}},
+		{name: "write error forward",
+			options:    AsyncOptions{AsyncOnQueueNearlyFullForwardTo(NewDiscard()), AsyncOnWriteErrorForwardToFallback()},
+			assertions: []assertFn{func(a *Async) bool { return a.writeErrorForward && a.onWriteError == nil }},
+		},
+		{name: "fallback nil", wantErr: true, options: AsyncOptions{AsyncFallback(nil)}},
+		{name: "fallback keeps the overflow strategy",
+			options: AsyncOptions{AsyncOnQueueNearlyFullDropNewest(), AsyncFallback(NewDiscard()), AsyncOnWriteErrorForwardToFallback()},
+			assertions: []assertFn{func(a *Async) bool {
+				_, dropNewest := a.overflow.(overflowDropNewest)
+				return dropNewest && a.fallback != nil && a.writeErrorForward
+			}},
+		},
+		{name: "write error handler and forward",
+			options: AsyncOptions{
+				AsyncOnWriteError(func(error, []byte, zapcore.Entry) {}),
+				AsyncOnQueueNearlyFullForwardTo(NewDiscard()),
+				AsyncOnWriteErrorForwardToFallback(),
+			},
+			assertions: []assertFn{func(a *Async) bool { return a.writeErrorForward && a.onWriteError != nil }},
+		},
+		{name: "enqueue timeout forward without fallback", wantErr: true, options: AsyncOptions{AsyncOnEnqueueTimeoutForwardToFallback()}},
+		{name: "enqueue timeout forward",
+			options:    AsyncOptions{AsyncOnQueueNearlyFullForwardTo(NewDiscard()), AsyncOnEnqueueTimeoutForwardToFallback()},
+			assertions: []assertFn{func(a *Async) bool { return a.enqueueTimeoutForward }},
+		},
+		{name: "overflow strategy nil", wantErr: true, options: AsyncOptions{AsyncOnQueueNearlyFull(nil)}},
+		{name: "clock nil", wantErr: true, options: AsyncOptions{AsyncClock(nil)}},
+		{name: "emergency nil", wantErr: true, options: AsyncOptions{AsyncEmergency(zapcore.FatalLevel, nil, time.Second)}},
+		{name: "emergency deadline zero", wantErr: true, options: AsyncOptions{AsyncEmergency(zapcore.FatalLevel, NewDiscard(), 0)}},
+		{name: "emergency level not synced by AppenderCore", wantErr: true, options: AsyncOptions{AsyncEmergency(zapcore.ErrorLevel, NewDiscard(), time.Second)}},
+		{name: "emergency",
+			options: AsyncOptions{AsyncEmergency(zapcore.DPanicLevel, NewDiscard(), time.Second)},
+			assertions: []assertFn{func(a *Async) bool {
+				return a.emergency != nil && a.emergencyLevel == zapcore.DPanicLevel && a.emergencyDeadline == time.Second
+			}},
+		},
+		{name: "enqueue timeout zero", wantErr: true, options: AsyncOptions{AsyncEnqueueTimeout(0)}},
+		{name: "memory budget nil", wantErr: true, options: AsyncOptions{AsyncMemoryBudget(nil, 0)}},
+		{name: "memory budget negative reservation", wantErr: true, options: AsyncOptions{
+			AsyncMemoryBudget(&MemoryBudget{max: 100, accounts: map[*memoryAccount]struct{}{}}, -1)}},
+		{name: "memory budget attached",
+			options: AsyncOptions{AsyncMemoryBudget(&MemoryBudget{max: 100, accounts: map[*memoryAccount]struct{}{}}, 40)},
+			assertions: []assertFn{func(a *Async) bool {
+				return a.memory != nil && a.memory.reserved == 40 && a.memory.budget.reserved == 40
+			}},
+		},
+		{name: "max queue bytes zero", wantErr: true, options: AsyncOptions{AsyncMaxQueueBytes(0)}},
+		{name: "min free bytes greater queue bytes", wantErr: true, options: AsyncOptions{
+			AsyncMaxQueueBytes(10),
+			AsyncQueueMinFreeBytes(100),
+		}},
+		{name: "min free percent calculation bytes",
+			options: AsyncOptions{
+				AsyncQueueMinFreePercent(0.2),
+				AsyncMaxQueueBytes(1000),
+			},
+			assertions: []assertFn{func(a *Async) bool { return a.limits().byteThreshold == 200 }},
+		},
+		{name: "bounded by bytes alone",
+			options: AsyncOptions{
+				AsyncMaxQueueLength(0),
+				AsyncMaxQueueBytes(6400),
+			},
+			assertions: []assertFn{func(a *Async) bool { return a.maxQueueLength == 100 }},
+		},
 		{name: "max queue length negative", wantErr: true, options: AsyncOptions{AsyncMaxQueueLength(-1)}},
 		{name: "queue monitor period negative", wantErr: true, options: AsyncOptions{AsyncQueueMonitorPeriod(-1 * time.Second)}},
 		{name: "queue monitor period zero", wantErr: true, options: AsyncOptions{AsyncQueueMonitorPeriod(0)}},
+		{name: "spill replay backoff zero", wantErr: true, options: AsyncOptions{AsyncSpillReplayBackoff(0)}},
+		{name: "spill replay backoff",
+			options:    AsyncOptions{AsyncQueueMonitorPeriod(time.Hour), AsyncSpillReplayBackoff(time.Minute)},
+			assertions: []assertFn{func(a *Async) bool { return a.spillReplayBackoff == time.Minute }},
+		},
 		{name: "async sync timeout negative", wantErr: true, options: AsyncOptions{AsyncSyncTimeout(-1 * time.Second)}},
 		{name: "sync sync timeout zero", wantErr: true, options: AsyncOptions{AsyncSyncTimeout(0)}},
 		{name: "min free items lt zero", wantErr: true, options: AsyncOptions{
@@ -47,14 +184,14 @@ func TestNewAsync(t *testing.T) {
 				AsyncQueueMinFreePercent(0.1),
 				AsyncMaxQueueLength(100),
 			},
-			assertions: []assertFn{func(a *Async) bool { return a.fallbackThreshold == 10 }},
+			assertions: []assertFn{func(a *Async) bool { return a.limits().fallbackThreshold == 10 }},
 		},
 		{name: "min free percent calculation 20",
 			options: AsyncOptions{
 				AsyncQueueMinFreePercent(0.2),
 				AsyncMaxQueueLength(10),
 			},
-			assertions: []assertFn{func(a *Async) bool { return a.fallbackThreshold == 2 }},
+			assertions: []assertFn{func(a *Async) bool { return a.limits().fallbackThreshold == 2 }},
 		},
 	}
 	for _, tt := range tests {
@@ -0,0 +1,115 @@
+package appender
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// overflowStrategy decides what Async does once the free space in its queue
+// drops below the threshold.
+type overflowStrategy interface {
+	// admit reports whether a new entry may be enqueued while the queue is nearly full.
+	// Entries that are not admitted are dropped.
+	admit(ent zapcore.Entry) bool
+	// evicts reports whether the queue monitor removes the oldest entries
+	// to restore the threshold.
+	evicts() bool
+	// evict handles an entry the queue monitor removed from the queue.
+	evict(a *Async, msg writeMessage)
+}
+
+// OverflowStrategy decides what Async does once the free space in its queue
+// drops below the threshold. It is set with AsyncOnQueueNearlyFull.
+type OverflowStrategy interface {
+	// Admit reports whether a new entry may be enqueued while the queue is nearly full.
+	// Entries that are not admitted are dropped. It is called by the writers concurrently.
+	Admit(ent zapcore.Entry) bool
+	// Evicts reports whether the queue monitor removes the oldest entries
+	// to restore the threshold.
+	Evicts() bool
+	// Evict handles an entry the queue monitor removed from the queue. It must not retain p.
+	// It returns DeliveryDiverted if it wrote the entry elsewhere; any other outcome counts as DeliveryDropped.
+	Evict(p []byte, ent zapcore.Entry) DeliveryOutcome
+}
+
+var (
+	_ overflowStrategy = overflowCustom{}
+	_ overflowStrategy = overflowBlock{}
+	_ overflowStrategy = overflowDropNewest{}
+	_ overflowStrategy = overflowDropOldest{}
+	_ overflowStrategy = overflowForward{}
+	_ overflowStrategy = overflowDropBelow{}
+)
+
+// overflowBlock keeps all entries. Write blocks while the queue is full.
+type overflowBlock struct{}
+
+func (overflowBlock) admit(zapcore.Entry) bool { return true }
+
+func (overflowBlock) evicts() bool { return false }
+
+func (overflowBlock) evict(*Async, writeMessage) {}
+
+// overflowDropNewest drops new entries while the queue is nearly full.
+type overflowDropNewest struct{}
+
+func (overflowDropNewest) admit(zapcore.Entry) bool { return false }
+
+func (overflowDropNewest) evicts() bool { return false }
+
+func (overflowDropNewest) evict(*Async, writeMessage) {}
+
+// overflowDropOldest drops the oldest queued entries.
+type overflowDropOldest struct{}
+
+func (overflowDropOldest) admit(zapcore.Entry) bool { return true }
+
+func (overflowDropOldest) evicts() bool { return true }
+
+func (overflowDropOldest) evict(a *Async, msg writeMessage) {
+	atomic.AddUint64(&a.stats.dropped, 1)
+	msg.receipt.resolve(DeliveryDropped, nil)
+}
+
+// overflowForward forwards the oldest queued entries to the fallback.
+type overflowForward struct{}
+
+func (overflowForward) admit(zapcore.Entry) bool { return true }
+
+func (overflowForward) evicts() bool { return true }
+
+func (overflowForward) evict(a *Async, msg writeMessage) {
+	a.divert(msg)
+}
+
+// overflowDropBelow drops new entries below level while the queue is nearly full.
+// Entries at or above level are enqueued, blocking Write while the queue is full.
+type overflowDropBelow struct {
+	level zapcore.Level
+}
+
+func (s overflowDropBelow) admit(ent zapcore.Entry) bool { return ent.Level >= s.level }
+
+func (overflowDropBelow) evicts() bool { return false }
+
+func (overflowDropBelow) evict(*Async, writeMessage) {}
+
+// overflowCustom is an OverflowStrategy set with AsyncOnQueueNearlyFull.
+type overflowCustom struct {
+	strategy OverflowStrategy
+}
+
+func (s overflowCustom) admit(ent zapcore.Entry) bool { return s.strategy.Admit(ent) }
+
+func (s overflowCustom) evicts() bool { return s.strategy.Evicts() }
+
+func (s overflowCustom) evict(a *Async, msg writeMessage) {
+	if s.strategy.Evict(msg.payload(), msg.ent) == DeliveryDiverted {
+		atomic.AddUint64(&a.stats.diverted, 1)
+		msg.receipt.resolve(DeliveryDiverted, nil)
+		return
+	}
+	atomic.AddUint64(&a.stats.dropped, 1)
+	msg.receipt.resolve(DeliveryDropped, nil)
+}
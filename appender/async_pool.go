@@ -0,0 +1,160 @@
+package appender
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// poolTurnMessages is the max number of messages an Async forwards in one turn
+// before the other appenders of its WorkerPool are served.
+const poolTurnMessages = 64
+
+// WorkerPool forwards and monitors the queues of many Async appenders
+// with a bounded number of goroutines instead of two goroutines per appender.
+// Appenders with queued messages are served in turns of up to 64 messages in the order
+// they became ready, so an appender with many queued messages does not starve the others.
+// A turn cannot be bounded in time, though: a write blocked in a primary appender
+// holds its goroutine until it returns. Size the pool larger than the number of
+// primary appenders that may block at once, e.g. on a stalled connection,
+// or the other appenders wait for them.
+type WorkerPool struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	queue  []*poolJob // FIFO of the jobs to run
+	closed bool
+	done   sync.WaitGroup
+}
+
+// NewWorkerPool starts a pool of size goroutines.
+func NewWorkerPool(size int) (*WorkerPool, error) {
+	if size <= 0 {
+		return nil, errors.New("size must be positive")
+	}
+	p := &WorkerPool{}
+	p.ready = sync.NewCond(&p.mu)
+	p.done.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p, nil
+}
+
+// Close stops the goroutines of the pool after their current turn.
+// The appenders using the pool must be shut down before.
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.queue = nil
+	p.mu.Unlock()
+	p.ready.Broadcast()
+	p.done.Wait()
+}
+
+func (p *WorkerPool) push(j *poolJob) {
+	p.mu.Lock()
+	if !p.closed {
+		p.queue = append(p.queue, j)
+	}
+	p.mu.Unlock()
+	p.ready.Signal()
+}
+
+// next blocks until a job is queued. It returns nil once the pool is closed.
+func (p *WorkerPool) next() *poolJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) == 0 && !p.closed {
+		p.ready.Wait()
+	}
+	if p.closed {
+		return nil
+	}
+	j := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return j
+}
+
+func (p *WorkerPool) work() {
+	defer p.done.Done()
+	for j := p.next(); j != nil; j = p.next() {
+		j.runTurn()
+	}
+}
+
+// poolJob is a task of an Async appender run by a WorkerPool.
+// It is queued at most once; a signal while it is queued or running makes it run once more.
+type poolJob struct {
+	scheduled int32
+	signalled int32
+	pool      *WorkerPool
+	// run does one turn of the task. It reports whether work is left.
+	run func() (more bool)
+}
+
+// signal schedules the job unless it is scheduled already.
+func (j *poolJob) signal() {
+	atomic.StoreInt32(&j.signalled, 1)
+	j.schedule()
+}
+
+func (j *poolJob) schedule() {
+	if atomic.CompareAndSwapInt32(&j.scheduled, 0, 1) {
+		j.pool.push(j)
+	}
+}
+
+func (j *poolJob) runTurn() {
+	atomic.StoreInt32(&j.signalled, 0)
+	more := j.run()
+	atomic.StoreInt32(&j.scheduled, 0)
+	// a signal during the turn might have found the job still scheduled
+	if more || atomic.LoadInt32(&j.signalled) != 0 {
+		j.schedule()
+	}
+}
+
+// initPoolJobs prepares the forwarding and the monitoring of a to run on its pool.
+func (a *Async) initPoolJobs() {
+	a.forwardJob = poolJob{pool: a.pool, run: a.forwardTurn}
+	a.monitorJob = poolJob{pool: a.pool, run: func() bool {
+		select {
+		case <-a.close:
+		default:
+			a.relieveOverflow()
+		}
+		return false
+	}}
+}
+
+// forwardTurn forwards up to poolTurnMessages messages. It reports whether messages are left.
+// It runs exclusively, like the forwarding routine of an Async without a pool.
+func (a *Async) forwardTurn() bool {
+	for i := 0; i < poolTurnMessages; i++ {
+		select {
+		case <-a.close:
+			if !a.forwardingStopped {
+				a.forwardingStopped = true
+				close(a.forwarding)
+			}
+			return false
+		default:
+		}
+		forwarded, backoff := a.forwardNext()
+		if backoff > 0 {
+			// the turns until then would not forward anything
+			if a.replayTimer == nil {
+				a.replayTimer = time.AfterFunc(backoff, a.forwardJob.signal)
+			} else {
+				a.replayTimer.Reset(backoff)
+			}
+			return false
+		}
+		if !forwarded {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package appender
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// DeliveryOutcome tells what happened to an entry written with Async.WriteWithReceipt.
+type DeliveryOutcome int
+
+const (
+	// DeliveryDelivered means the primary appender wrote the entry.
+	DeliveryDelivered DeliveryOutcome = iota + 1
+	// DeliveryFailed means the primary appender returned an error for the entry.
+	DeliveryFailed
+	// DeliveryDiverted means the entry was written to the fallback instead of the primary appender.
+	DeliveryDiverted
+	// DeliverySpilled means the entry was pushed to the spill queue.
+	// It is replayed later, but its receipt does not follow it.
+	DeliverySpilled
+	// DeliveryDropped means the entry was discarded.
+	DeliveryDropped
+)
+
+func (o DeliveryOutcome) String() string {
+	switch o {
+	case DeliveryDelivered:
+		return "delivered"
+	case DeliveryFailed:
+		return "failed"
+	case DeliveryDiverted:
+		return "diverted"
+	case DeliverySpilled:
+		return "spilled"
+	case DeliveryDropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// Receipt resolves once the entry it was returned for left the Async appender.
+type Receipt struct {
+	done    chan struct{}
+	outcome DeliveryOutcome
+	err     error
+}
+
+func newReceipt() *Receipt {
+	return &Receipt{done: make(chan struct{})}
+}
+
+// Done is closed once the receipt is resolved.
+func (r *Receipt) Done() <-chan struct{} {
+	return r.done
+}
+
+// Outcome returns what happened to the entry. It must only be called after Done is closed.
+func (r *Receipt) Outcome() DeliveryOutcome {
+	return r.outcome
+}
+
+// Err returns the error of the primary appender if it failed to write the entry,
+// which is DeliveryFailed or DeliveryDiverted with AsyncOnWriteErrorForwardToFallback.
+// It must only be called after Done is closed.
+func (r *Receipt) Err() error {
+	return r.err
+}
+
+// Wait blocks until the receipt is resolved or ctx is done.
+func (r *Receipt) Wait(ctx context.Context) (DeliveryOutcome, error) {
+	select {
+	case <-r.done:
+		return r.outcome, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// resolve sets the outcome. Messages without a receipt are ignored.
+func (r *Receipt) resolve(outcome DeliveryOutcome, err error) {
+	if r == nil {
+		return
+	}
+	r.outcome = outcome
+	r.err = err
+	close(r.done)
+}
+
+// WriteWithReceipt enqueues like Write, but returns a receipt telling whether
+// the entry was delivered, diverted or dropped.
+// It returns an error instead of a receipt if the entry was not accepted, e.g. after Shutdown.
+func (a *Async) WriteWithReceipt(p []byte, ent zapcore.Entry) (*Receipt, error) {
+	receipt := newReceipt()
+	if _, err := a.write(p, ent, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// divert writes msg to the fallback.
+func (a *Async) divert(msg writeMessage) {
+	if !a.writeFallback(msg) {
+		atomic.AddUint64(&a.stats.dropped, 1)
+		msg.receipt.resolve(DeliveryDropped, nil)
+		return
+	}
+	atomic.AddUint64(&a.stats.diverted, 1)
+	msg.receipt.resolve(DeliveryDiverted, nil)
+}
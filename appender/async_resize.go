@@ -0,0 +1,203 @@
+package appender
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// queueLimits are the sizes of the queue that Resize changes while writers read them.
+type queueLimits struct {
+	maxQueueLength    int
+	fallbackThreshold int
+	byteThreshold     int64
+}
+
+// laneThreshold shares the threshold with a lane proportionally to its capacity.
+func (l *queueLimits) laneThreshold(capacity int) int {
+	if l.maxQueueLength == 0 {
+		return 0
+	}
+	return l.fallbackThreshold * capacity / l.maxQueueLength
+}
+
+func (a *Async) limits() *queueLimits {
+	return a.queueLimits.Load().(*queueLimits)
+}
+
+// calculateLimits calculates the thresholds for the configured max queue length.
+func (a *Async) calculateLimits() (*queueLimits, error) {
+	limits := &queueLimits{maxQueueLength: a.maxQueueLength}
+	var err error
+	limits.fallbackThreshold, err = a.calculateDropThresholdFn(a)
+	if err != nil {
+		return nil, err
+	}
+	limits.byteThreshold, err = a.calculateByteThresholdFn(a)
+	if err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// Resize changes the max queue length while the appender runs.
+// The lane capacities are scaled proportionally; 0 keeps the current length.
+// The min free threshold is recalculated for the new length,
+// using the options passed to Resize or else the one the appender was configured with.
+//
+// No message is lost: a shrunk queue may hold more messages than its new length
+// until they are forwarded or evicted, and messages queued before the resize are forwarded first.
+// Resize returns once no Write uses the replaced queue anymore.
+// If ctx is done before, it returns the error of ctx and the following Resize completes it.
+// A following Resize also waits until the replaced queue is drained.
+func (a *Async) Resize(ctx context.Context, maxQueueLength int, minFree ...AsyncThresholdOption) error {
+	if maxQueueLength < 0 {
+		return errors.New("length must not be negative")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	a.resizeMu.Lock()
+	defer a.resizeMu.Unlock()
+	if atomic.LoadInt32(&a.shutdown) != 0 {
+		return ErrAppenderShutdown
+	}
+	if err := a.settle(ctx); err != nil {
+		return err
+	}
+	// a lane holds a single retired ring
+	if err := poll(ctx, a.retiredDrained); err != nil {
+		return err
+	}
+
+	capacities := a.laneCapacities(maxQueueLength)
+	limits, err := a.recalculateLimits(capacities, minFree)
+	if err != nil {
+		return err
+	}
+	for i, l := range a.lanes {
+		l.resize(capacities[i], limits.laneThreshold(capacities[i]))
+	}
+	a.queueLimits.Store(limits)
+	// the lower threshold might be crossed already
+	for _, l := range a.lanes {
+		if a.nearlyFull(l) {
+			a.signalOverflow()
+			break
+		}
+	}
+
+	atomic.AddUint32(&a.epoch, 1)
+	a.unsettled = true
+	return a.settle(ctx)
+}
+
+// laneCapacities scales the configured lane capacities to maxQueueLength.
+func (a *Async) laneCapacities(maxQueueLength int) []int {
+	capacities := make([]int, len(a.lanes))
+	configured := 0
+	for _, l := range a.lanes {
+		configured += l.configured
+	}
+	for i, l := range a.lanes {
+		capacities[i] = l.current().ring.cap()
+		if maxQueueLength > 0 {
+			capacities[i] = l.configured * maxQueueLength / configured
+		}
+		if capacities[i] < 1 {
+			capacities[i] = 1
+		}
+	}
+	return capacities
+}
+
+// recalculateLimits applies minFree and calculates the limits for the lane capacities.
+// On error the configuration is left unchanged.
+func (a *Async) recalculateLimits(capacities []int, minFree []AsyncThresholdOption) (*queueLimits, error) {
+	maxQueueLength, dropFn, byteFn := a.maxQueueLength, a.calculateDropThresholdFn, a.calculateByteThresholdFn
+	a.maxQueueLength = 0
+	for _, c := range capacities {
+		a.maxQueueLength += c
+	}
+	limits, err := func() (*queueLimits, error) {
+		for _, option := range minFree {
+			if err := option.apply(a); err != nil {
+				return nil, err
+			}
+		}
+		return a.calculateLimits()
+	}()
+	if err != nil {
+		a.maxQueueLength, a.calculateDropThresholdFn, a.calculateByteThresholdFn = maxQueueLength, dropFn, byteFn
+	}
+	return limits, err
+}
+
+// enterWrite counts a Write in progress in the current epoch.
+// It returns the counter to decrement when the Write is done.
+func (a *Async) enterWrite() *int32 {
+	for {
+		epoch := atomic.LoadUint32(&a.epoch)
+		writers := &a.writers[epoch%2]
+		atomic.AddInt32(writers, 1)
+		if atomic.LoadUint32(&a.epoch) == epoch {
+			return writers
+		}
+		// Resize might have missed the increment, count it in the new epoch
+		atomic.AddInt32(writers, -1)
+	}
+}
+
+// settle waits until the writers of the epoch before the last Resize finished,
+// so they no longer push to the retired rings.
+func (a *Async) settle(ctx context.Context) error {
+	if !a.unsettled {
+		return nil
+	}
+	writers := &a.writers[(atomic.LoadUint32(&a.epoch)-1)%2]
+	err := poll(ctx, func() bool { return atomic.LoadInt32(writers) == 0 })
+	if err != nil {
+		return err
+	}
+	for _, l := range a.lanes {
+		if r := l.retiredRing(); r != nil {
+			atomic.StoreInt32(&r.settled, 1)
+			l.dropRetired(r)
+		}
+	}
+	a.unsettled = false
+	return nil
+}
+
+// retiredDrained reports whether all retired rings are drained.
+func (a *Async) retiredDrained() bool {
+	for _, l := range a.lanes {
+		if r := l.retiredRing(); r != nil && !l.dropRetired(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// resizePollInterval is how often Resize checks whether the writers and the forwarding routine caught up.
+const resizePollInterval = time.Millisecond
+
+// poll returns once done returns true or with the error of ctx.
+func poll(ctx context.Context, done func() bool) error {
+	if done() {
+		return nil
+	}
+	ticker := time.NewTicker(resizePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if done() {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package appender
+
+import (
+	"sync/atomic"
+)
+
+// cacheLinePad separates the ring positions to avoid false sharing between producers and consumers.
+const cacheLinePad = 64
+
+// ring is a bounded lock-free queue of messages.
+// Producers and consumers claim positions by CAS, using a sequence number per slot
+// (see Dmitry Vyukov's bounded MPMC queue).
+// Async has many producers, the writers, and pops from the head in the forwarding routine;
+// the monitor evicting the head is the only other consumer.
+type ring struct {
+	_    [cacheLinePad]byte
+	tail uint64 // next position to push
+	_    [cacheLinePad - 8]byte
+	head uint64 // next position to pop
+	_    [cacheLinePad - 8]byte
+
+	slots []slot
+	size  uint64
+}
+
+type slot struct {
+	// seq is the operation the slot is ready for:
+	// 2*pos to push at pos, 2*pos+1 to pop at pos.
+	// Doubling the positions keeps the states distinct for a single slot.
+	seq uint64
+	msg writeMessage
+}
+
+func newRing(capacity int) *ring {
+	if capacity < 1 {
+		capacity = 1
+	}
+	r := &ring{
+		slots: make([]slot, capacity),
+		size:  uint64(capacity),
+	}
+	for i := range r.slots {
+		r.slots[i].seq = 2 * uint64(i)
+	}
+	return r
+}
+
+// push appends msg. It returns false if the ring is full.
+func (r *ring) push(msg writeMessage) bool {
+	pos := atomic.LoadUint64(&r.tail)
+	for {
+		s := &r.slots[pos%r.size]
+		seq := atomic.LoadUint64(&s.seq)
+		switch diff := int64(seq - 2*pos); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&r.tail, pos, pos+1) {
+				s.msg = msg
+				atomic.StoreUint64(&s.seq, 2*pos+1)
+				return true
+			}
+			pos = atomic.LoadUint64(&r.tail)
+		case diff < 0:
+			// full, the slot still holds the message pushed one round before
+			return false
+		default:
+			// another producer claimed pos
+			pos = atomic.LoadUint64(&r.tail)
+		}
+	}
+}
+
+// pop removes the oldest message. It returns false if the ring is empty.
+func (r *ring) pop() (msg writeMessage, ok bool) {
+	pos := atomic.LoadUint64(&r.head)
+	for {
+		s := &r.slots[pos%r.size]
+		seq := atomic.LoadUint64(&s.seq)
+		switch diff := int64(seq - (2*pos + 1)); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&r.head, pos, pos+1) {
+				msg = s.msg
+				s.msg = writeMessage{}
+				atomic.StoreUint64(&s.seq, 2*(pos+r.size))
+				return msg, true
+			}
+			pos = atomic.LoadUint64(&r.head)
+		case diff < 0:
+			// empty, or the message at pos is not pushed completely yet
+			return msg, false
+		default:
+			// another consumer popped pos
+			pos = atomic.LoadUint64(&r.head)
+		}
+	}
+}
+
+// peek returns the oldest message without removing it.
+// It must only be called while no other goroutine pops.
+func (r *ring) peek() (msg writeMessage, ok bool) {
+	pos := atomic.LoadUint64(&r.head)
+	s := &r.slots[pos%r.size]
+	if atomic.LoadUint64(&s.seq) != 2*pos+1 {
+		return msg, false
+	}
+	return s.msg, true
+}
+
+// len returns the number of pushed and not yet popped messages.
+// Messages in the middle of a push or pop are counted.
+func (r *ring) len() int {
+	for {
+		head := atomic.LoadUint64(&r.head)
+		tail := atomic.LoadUint64(&r.tail)
+		if atomic.LoadUint64(&r.head) != head {
+			// a consumer moved on between the loads
+			continue
+		}
+		return int(tail - head)
+	}
+}
+
+func (r *ring) cap() int {
+	return int(r.size)
+}
@@ -0,0 +1,186 @@
+package appender
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func ringMessage(i int) writeMessage {
+	return writeMessage{ent: zapcore.Entry{Level: zapcore.Level(i % 5), Message: string(rune('a' + i%26))}}
+}
+
+func TestRing_pushPop_keepsOrderAndBounds(t *testing.T) {
+	for _, capacity := range []int{1, 2, 3, 8} {
+		r := newRing(capacity)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < capacity; i++ {
+				if !r.push(ringMessage(i)) {
+					t.Fatalf("capacity %d: push %d failed", capacity, i)
+				}
+			}
+			if r.push(ringMessage(0)) {
+				t.Fatalf("capacity %d: push to a full ring succeeded", capacity)
+			}
+			if r.len() != capacity {
+				t.Fatalf("capacity %d: unexpected len %d", capacity, r.len())
+			}
+			if msg, ok := r.peek(); !ok || msg.ent != ringMessage(0).ent {
+				t.Fatalf("capacity %d: unexpected peek %v %v", capacity, msg.ent, ok)
+			}
+			for i := 0; i < capacity; i++ {
+				msg, ok := r.pop()
+				if !ok || msg.ent != ringMessage(i).ent {
+					t.Fatalf("capacity %d: unexpected pop %d: %v %v", capacity, i, msg.ent, ok)
+				}
+			}
+			if _, ok := r.pop(); ok {
+				t.Fatalf("capacity %d: pop from an empty ring succeeded", capacity)
+			}
+			if _, ok := r.peek(); ok {
+				t.Fatalf("capacity %d: peek on an empty ring succeeded", capacity)
+			}
+		}
+	}
+}
+
+func TestRing_concurrentProducersAndConsumers(t *testing.T) {
+	r := newRing(16)
+	producers, perProducer := 8, 1000
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				msg := writeMessage{ent: zapcore.Entry{Level: zapcore.Level(p), Message: string(rune(i))}}
+				for !r.push(msg) {
+					runtime.Gosched()
+				}
+				if depth := r.len(); depth < 0 || depth > r.cap() {
+					t.Errorf("unexpected len %d", depth)
+				}
+			}
+		}(p)
+	}
+
+	// the forwarding routine and the monitor both pop
+	received := int64(0)
+	done := make(chan struct{})
+	var consumers sync.WaitGroup
+	for c := 0; c < 2; c++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for {
+				if _, ok := r.pop(); ok {
+					atomic.AddInt64(&received, 1)
+					continue
+				}
+				select {
+				case <-done:
+					return
+				default:
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for r.len() > 0 {
+		runtime.Gosched()
+	}
+	close(done)
+	consumers.Wait()
+
+	if received != int64(producers*perProducer) {
+		t.Errorf("expected %d messages, got %d", producers*perProducer, received)
+	}
+}
+
+func TestRing_singleConsumer_keepsOrderPerProducer(t *testing.T) {
+	r := newRing(4)
+	producers, perProducer := 4, 1000
+
+	for p := 0; p < producers; p++ {
+		go func(p int) {
+			for i := 0; i < perProducer; i++ {
+				msg := writeMessage{ent: zapcore.Entry{Level: zapcore.Level(p), Message: string(rune(i))}}
+				for !r.push(msg) {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+
+	last := make([]int, producers)
+	for i := range last {
+		last[i] = -1
+	}
+	for received := 0; received < producers*perProducer; {
+		msg, ok := r.pop()
+		if !ok {
+			runtime.Gosched()
+			continue
+		}
+		received++
+		p, i := int(msg.ent.Level), int([]rune(msg.ent.Message)[0])
+		if i != last[p]+1 {
+			t.Fatalf("producer %d: got %d after %d", p, i, last[p])
+		}
+		last[p] = i
+	}
+}
+
+// BenchmarkQueue compares the ring to the buffered channel it replaced
+// with parallel producers and a single consumer.
+func BenchmarkQueue(b *testing.B) {
+	msg := ringMessage(1)
+	b.Run("channel", func(b *testing.B) {
+		queue := make(chan writeMessage, 1000)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-queue:
+				case <-done:
+					return
+				}
+			}
+		}()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				queue <- msg
+			}
+		})
+		close(done)
+	})
+	b.Run("ring", func(b *testing.B) {
+		l := newLane(zapcore.DebugLevel, 1000, 0, func() {})
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, ok := l.pop(); !ok {
+					runtime.Gosched()
+				}
+			}
+		}()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_ = l.push(msg, &enqueueWait{closed: done})
+			}
+		})
+		close(done)
+	})
+}
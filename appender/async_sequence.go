@@ -0,0 +1,76 @@
+package appender
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// sequencer stamps the messages of an Async with sequence numbers in queue order
+// and keeps the order of the messages written to the fallback.
+type sequencer struct {
+	mu   sync.Mutex
+	last uint64 // the sequence number of the last enqueued message
+
+	fallbackMu   sync.Mutex
+	fallbackLast uint64 // the sequence number of the last message written to the fallback
+}
+
+// validateSequenced rejects the options that would reorder the messages of a destination.
+func (a *Async) validateSequenced() error {
+	switch {
+	case len(a.laneConfig) > 1:
+		return errors.New("sequence numbers cannot be combined with level lanes")
+	case a.workerCount > 1:
+		return errors.New("sequence numbers cannot be combined with forwarding workers")
+	case a.spill != nil:
+		return errors.New("sequence numbers cannot be combined with a spill queue")
+	case a.enqueueTimeoutForward:
+		return errors.New("sequence numbers cannot be combined with forwarding timed out enqueues")
+	}
+	return nil
+}
+
+// pushSequenced stamps msg with the next sequence number and pushes it to l.
+// Both happen under a lock, so the queue holds the messages in the order of their numbers.
+// The lock is not held while waiting for space.
+func (a *Async) pushSequenced(l *lane, msg writeMessage, w *enqueueWait) error {
+	return l.pushWith(w, func(r *ring) bool {
+		a.sequencer.mu.Lock()
+		defer a.sequencer.mu.Unlock()
+		msg.seq = a.sequencer.last + 1
+		if !r.push(msg) {
+			return false
+		}
+		a.sequencer.last = msg.seq
+		return true
+	})
+}
+
+// writeFallback writes msg to the fallback. It reports whether msg was written.
+// With sequence numbers, the monitoring and the forwarding routine both write to the fallback,
+// so msg is not written if a later message reached the fallback already.
+func (a *Async) writeFallback(msg writeMessage) bool {
+	if !a.sequenced {
+		_, _ = a.fallback.Write(msg.buf.Bytes(), msg.ent)
+		return true
+	}
+	a.sequencer.fallbackMu.Lock()
+	defer a.sequencer.fallbackMu.Unlock()
+	if msg.seq < a.sequencer.fallbackLast {
+		atomic.AddUint64(&a.stats.outOfOrder, 1)
+		return false
+	}
+	a.sequencer.fallbackLast = msg.seq
+	_, _ = writeSequenced(a.fallback, msg.buf.Bytes(), msg.ent, msg.seq)
+	return true
+}
+
+// writePrimary writes msg to the primary.
+// Only the forwarding routine writes to the primary, so it receives the messages in queue order.
+func (a *Async) writePrimary(msg writeMessage) (int, error) {
+	if !a.sequenced {
+		return a.primary.Write(msg.payload(), msg.ent)
+	}
+	return writeSequenced(a.primary, msg.payload(), msg.ent, msg.seq)
+}
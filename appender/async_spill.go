@@ -0,0 +1,111 @@
+package appender
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// SpillQueue persists the entries Async evicts from its in-memory queue.
+// diskqueue.Queue implements SpillQueue.
+type SpillQueue interface {
+	// Push appends an entry. It must not retain p.
+	Push(p []byte, ent zapcore.Entry) error
+	// Peek returns the oldest entry without removing it.
+	// p is only valid until the next call. ok is false if the queue is empty.
+	// An error means the oldest entry cannot be read; Async pops it then.
+	Peek() (p []byte, ent zapcore.Entry, ok bool, err error)
+	// Pop removes the oldest entry.
+	Pop() error
+	// Sync commits the pushed entries to stable storage.
+	Sync() error
+}
+
+var _ overflowStrategy = overflowSpill{}
+
+// overflowSpill pushes the oldest queued entries to the spill queue.
+// Entries the spill queue rejects are forwarded to the fallback.
+type overflowSpill struct{}
+
+func (overflowSpill) admit(zapcore.Entry) bool { return true }
+
+func (overflowSpill) evicts() bool { return true }
+
+func (overflowSpill) evict(a *Async, msg writeMessage) {
+	if a.spill.Push(msg.buf.Bytes(), msg.ent) == nil {
+		atomic.AddUint64(&a.stats.spilled, 1)
+		msg.receipt.resolve(DeliverySpilled, nil)
+		return
+	}
+	overflowForward{}.evict(a, msg)
+}
+
+// replaySpilled writes the oldest spilled entry to the primary.
+// As the spilled entries are older than the queued ones, they are replayed first.
+// It returns false if there was no entry to replay.
+// A spilled entry that cannot be read is skipped.
+// A spilled entry older than the max age is dropped, forwarded to the fallback or annotated like a queued one.
+// A spilled entry the primary fails to write is handled like a queued one:
+// it is reported to the AsyncOnWriteError handler and written to the fallback with AsyncOnWriteErrorForwardToFallback,
+// otherwise it is kept and retried after the backoff set with AsyncSpillReplayBackoff.
+// only called by the forwarding routine
+func (a *Async) replaySpilled() bool {
+	p, ent, ok, err := a.spill.Peek()
+	if err != nil {
+		a.skipSpilled()
+		return true
+	}
+	if !ok {
+		return false
+	}
+	if a.maxAge != 0 && !ent.Time.IsZero() {
+		if age := a.clock.Now().Sub(ent.Time); age > a.maxAge {
+			annotated, replay := a.handleStaleSpilled(p, ent, age)
+			if !replay {
+				return true
+			}
+			if annotated != nil {
+				defer annotated.Free()
+				p = annotated.Bytes()
+			}
+		}
+	}
+
+	start := time.Now()
+	_, err = a.primary.Write(p, ent)
+	a.stats.addPrimaryWrite(time.Since(start))
+	if err == nil {
+		a.popSpilled(&a.stats.delivered)
+		return true
+	}
+	atomic.AddUint64(&a.stats.failed, 1)
+	if a.onWriteError != nil {
+		a.onWriteError(err, p, ent)
+	}
+	if a.writeErrorForward {
+		_, _ = a.fallback.Write(p, ent)
+		a.popSpilled(&a.stats.diverted)
+		return true
+	}
+	a.replayAfter = time.Now().Add(a.spillReplayBackoff)
+	return true
+}
+
+// popSpilled pops the oldest spilled entry and increments counter.
+func (a *Async) popSpilled(counter *uint64) {
+	if a.spill.Pop() == nil {
+		atomic.AddUint64(counter, 1)
+	}
+}
+
+// skipSpilled pops the oldest spilled entry, which cannot be read.
+// If it cannot be popped either, e.g. as the spill queue is closed, replaying backs off.
+func (a *Async) skipSpilled() {
+	if a.spill.Pop() != nil {
+		a.replayAfter = time.Now().Add(a.spillReplayBackoff)
+		return
+	}
+	atomic.AddUint64(&a.stats.spillSkipped, 1)
+	atomic.AddUint64(&a.stats.dropped, 1)
+}
@@ -0,0 +1,90 @@
+package appender
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/delixfe/zap_ing/appender/internal/bufferpool"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// StaleAnnotateFn writes p, annotated as being age old, into output.
+// It is called from the forwarding routine for entries older than the max age.
+type StaleAnnotateFn func(p []byte, ent zapcore.Entry, age time.Duration, output *buffer.Buffer) error
+
+// staleAction is what Async does with an entry older than the max age.
+type staleAction int
+
+const (
+	staleDrop staleAction = iota + 1
+	staleForward
+	staleAnnotate
+)
+
+// dequeue returns the next queued message like nextMessage.
+// Messages older than the max age are dropped, forwarded to the fallback or annotated on the way.
+func (a *Async) dequeue() (msg writeMessage, ok bool) {
+	for {
+		msg, ok = a.nextMessage()
+		if !ok || a.maxAge == 0 || msg.flush != nil || msg.ent.Time.IsZero() {
+			return msg, ok
+		}
+		age := a.clock.Now().Sub(msg.ent.Time)
+		if age <= a.maxAge || a.handleStale(&msg, age) {
+			return msg, true
+		}
+	}
+}
+
+// handleStale handles a message older than the max age.
+// It reports whether msg is still to be forwarded, which it is after it was annotated.
+func (a *Async) handleStale(msg *writeMessage, age time.Duration) bool {
+	switch a.staleAction {
+	case staleAnnotate:
+		annotated := bufferpool.Get()
+		if err := a.staleAnnotateFn(msg.buf.Bytes(), msg.ent, age, annotated); err != nil {
+			// forwarded as is
+			annotated.Free()
+			return true
+		}
+		msg.annotated = annotated
+		atomic.AddUint64(&a.stats.staleAnnotated, 1)
+		return true
+	case staleForward:
+		atomic.AddUint64(&a.stats.staleDiverted, 1)
+		a.divert(*msg)
+	default:
+		atomic.AddUint64(&a.stats.staleDropped, 1)
+		atomic.AddUint64(&a.stats.dropped, 1)
+		msg.receipt.resolve(DeliveryDropped, nil)
+	}
+	a.stats.addWait(*msg, a.clock.Now())
+	a.release(*msg)
+	return false
+}
+
+// handleStaleSpilled handles a spilled entry older than the max age like handleStale.
+// It returns the annotated entry to replay instead of p, if any,
+// and reports whether the entry is still to be replayed. Otherwise, it is popped.
+func (a *Async) handleStaleSpilled(p []byte, ent zapcore.Entry, age time.Duration) (annotated *buffer.Buffer, replay bool) {
+	switch a.staleAction {
+	case staleAnnotate:
+		annotated = bufferpool.Get()
+		if err := a.staleAnnotateFn(p, ent, age, annotated); err != nil {
+			// replayed as is
+			annotated.Free()
+			return nil, true
+		}
+		atomic.AddUint64(&a.stats.staleAnnotated, 1)
+		return annotated, true
+	case staleForward:
+		atomic.AddUint64(&a.stats.staleDiverted, 1)
+		_, _ = a.fallback.Write(p, ent)
+		a.popSpilled(&a.stats.diverted)
+	default:
+		atomic.AddUint64(&a.stats.staleDropped, 1)
+		a.popSpilled(&a.stats.dropped)
+	}
+	return nil, false
+}
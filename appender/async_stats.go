@@ -0,0 +1,133 @@
+package appender
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AsyncStats is a snapshot of the delivery statistics of an Async appender.
+type AsyncStats struct {
+	// Enqueued counts the entries accepted into the queue.
+	Enqueued uint64
+	// Delivered counts the entries the primary appender wrote without an error.
+	Delivered uint64
+	// Failed counts the entries the primary appender returned an error for.
+	Failed uint64
+	// Diverted counts the entries written to the fallback instead of the primary appender.
+	Diverted uint64
+	// Dropped counts the entries that were discarded.
+	Dropped uint64
+	// Spilled counts the entries pushed to the spill queue.
+	// Replayed entries are counted as Delivered.
+	Spilled uint64
+	// StaleDropped counts the entries dropped as older than the max age, which are also counted as Dropped.
+	StaleDropped uint64
+	// StaleDiverted counts the entries written to the fallback as older than the max age,
+	// which are also counted as Diverted.
+	StaleDiverted uint64
+	// OutOfOrder counts the entries dropped with AsyncSequenceNumbers,
+	// as a later entry had reached their destination already. They are also counted as Dropped.
+	OutOfOrder uint64
+	// Emergency counts the entries written to the emergency appender instead of being queued.
+	Emergency uint64
+	// StaleAnnotated counts the entries annotated as older than the max age before they were forwarded.
+	StaleAnnotated uint64
+	// SpillSkipped counts the spilled entries that could not be read back and were skipped,
+	// which are also counted as Dropped.
+	SpillSkipped uint64
+
+	// QueueDepth is the number of entries currently queued.
+	QueueDepth int
+	// QueueHighWater is the highest queue depth observed.
+	QueueHighWater int
+	// QueueBytes is the number of bytes currently queued.
+	QueueBytes int64
+
+	// WaitTotal is the sum of the time entries spent between Entry.Time and leaving the queue.
+	WaitTotal time.Duration
+	// WaitMax is the longest time an entry spent between Entry.Time and leaving the queue.
+	WaitMax time.Duration
+
+	// PrimaryWriteTotal is the sum of the time spent writing to the primary appender.
+	PrimaryWriteTotal time.Duration
+	// PrimaryWriteMax is the longest time a single write to the primary appender took.
+	PrimaryWriteMax time.Duration
+}
+
+// asyncCounters are updated atomically.
+// It must be the first field of Async to keep the 64-bit values aligned on 32-bit platforms.
+type asyncCounters struct {
+	enqueued          uint64
+	delivered         uint64
+	failed            uint64
+	diverted          uint64
+	dropped           uint64
+	spilled           uint64
+	staleDropped      uint64
+	staleDiverted     uint64
+	staleAnnotated    uint64
+	outOfOrder        uint64
+	emergency         uint64
+	spillSkipped      uint64
+	waitTotal         int64
+	waitMax           int64
+	primaryWriteTotal int64
+	primaryWriteMax   int64
+	queueHighWater    int64
+	queueBytes        int64
+}
+
+func (c *asyncCounters) addWait(msg writeMessage, now time.Time) {
+	if msg.ent.Time.IsZero() {
+		return
+	}
+	wait := int64(now.Sub(msg.ent.Time))
+	atomic.AddInt64(&c.waitTotal, wait)
+	storeMaxInt64(&c.waitMax, wait)
+}
+
+func (c *asyncCounters) addPrimaryWrite(d time.Duration) {
+	atomic.AddInt64(&c.primaryWriteTotal, int64(d))
+	storeMaxInt64(&c.primaryWriteMax, int64(d))
+}
+
+func (c *asyncCounters) observeDepth(depth int) {
+	storeMaxInt64(&c.queueHighWater, int64(depth))
+}
+
+func storeMaxInt64(addr *int64, val int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if val <= old || atomic.CompareAndSwapInt64(addr, old, val) {
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the delivery statistics.
+// The counters are read one by one, so they might not be consistent with each other.
+func (a *Async) Stats() AsyncStats {
+	depth := a.queueDepth()
+	a.stats.observeDepth(depth)
+	return AsyncStats{
+		Enqueued:          atomic.LoadUint64(&a.stats.enqueued),
+		Delivered:         atomic.LoadUint64(&a.stats.delivered),
+		Failed:            atomic.LoadUint64(&a.stats.failed),
+		Diverted:          atomic.LoadUint64(&a.stats.diverted),
+		Dropped:           atomic.LoadUint64(&a.stats.dropped),
+		Spilled:           atomic.LoadUint64(&a.stats.spilled),
+		StaleDropped:      atomic.LoadUint64(&a.stats.staleDropped),
+		StaleDiverted:     atomic.LoadUint64(&a.stats.staleDiverted),
+		StaleAnnotated:    atomic.LoadUint64(&a.stats.staleAnnotated),
+		OutOfOrder:        atomic.LoadUint64(&a.stats.outOfOrder),
+		Emergency:         atomic.LoadUint64(&a.stats.emergency),
+		SpillSkipped:      atomic.LoadUint64(&a.stats.spillSkipped),
+		QueueDepth:        depth,
+		QueueHighWater:    int(atomic.LoadInt64(&a.stats.queueHighWater)),
+		QueueBytes:        atomic.LoadInt64(&a.stats.queueBytes),
+		WaitTotal:         time.Duration(atomic.LoadInt64(&a.stats.waitTotal)),
+		WaitMax:           time.Duration(atomic.LoadInt64(&a.stats.waitMax)),
+		PrimaryWriteTotal: time.Duration(atomic.LoadInt64(&a.stats.primaryWriteTotal)),
+		PrimaryWriteMax:   time.Duration(atomic.LoadInt64(&a.stats.primaryWriteMax)),
+	}
+}
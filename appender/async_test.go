@@ -2,14 +2,19 @@ package appender_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/delixfe/zap_ing/appender"
 	"github.com/delixfe/zap_ing/appender/chaos"
+	"github.com/delixfe/zap_ing/appender/diskqueue"
 
+	"go.uber.org/zap/buffer"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -39,6 +44,14 @@ func Write(a appender.Appender) error {
 	return err
 }
 
+// AwaitDequeued waits until the queue of a is empty, e.g. as the forwarder picked up the first entry.
+// It gives up after a few seconds, so the assertions following it report the failure.
+func AwaitDequeued(a *appender.Async) {
+	for i := 0; i < 5000 && a.Stats().QueueDepth != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func AssertWrittenEquals(t *testing.T, expected uint64, written func() uint64, msg string) {
 	actual := written()
 	if actual != expected {
@@ -140,7 +153,6 @@ func TestAsync(t *testing.T) {
 			queueLength: 1,
 			threshold:   0,
 			write:       10,
-			options:     AsyncOptions{appender.AsyncQueueMonitorPeriod(time.Hour)},
 			broken:      expectCounters{primary: 0, fallback: 0, blocked: 1}, // one is consumed by blocking, 1 in queue
 			fixed:       expectCounters{primary: 10, fallback: 0},
 		}},
@@ -157,7 +169,6 @@ func TestAsync(t *testing.T) {
 				appender.AsyncOnQueueNearlyFullForwardTo(fallback),
 				appender.AsyncMaxQueueLength(tt.args.queueLength),
 				appender.AsyncQueueMinFreeItems(tt.args.threshold),
-				appender.AsyncQueueMonitorPeriod(time.Millisecond),
 			}
 			async, _ := appender.NewAsync(blocking,
 				append(options, tt.args.options...)...,
@@ -171,13 +182,17 @@ func TestAsync(t *testing.T) {
 				blocked:  func() uint64 { return atomic.LoadUint64(&blocked) },
 				errors:   func() uint64 { return atomic.LoadUint64(&errors) },
 			}
+			write := tt.args.write
 			go func() {
-				for i := 0; i < tt.args.write; i++ {
+				for i := 0; i < write; i++ {
 					atomic.AddUint64(&blocked, 1)
 					if Write(async) != nil {
 						atomic.AddUint64(&errors, 1)
 					}
 					atomic.AddUint64(&blocked, ^uint64(0))
+					if i == 0 {
+						AwaitDequeued(async)
+					}
 				}
 			}()
 
@@ -210,3 +225,1626 @@ func TestAsync_Write_afterShutdown_returnsErr(t *testing.T) {
 	AssertWrittenEquals(t, 0, primaryCounter, "primary")
 	AssertWrittenEquals(t, 0, fallbackCounter, "fallback")
 }
+
+func TestAsync_OnWriteError_receivesErrorAndEntry(t *testing.T) {
+	primary, _ := NewWriteCountingAppender()
+	failing := chaos.NewFailingSwitchable(primary)
+	failing.Break()
+
+	var gotErr error
+	var gotP []byte
+	var gotEnt zapcore.Entry
+	async, _ := appender.NewAsync(failing,
+		appender.AsyncOnWriteError(func(err error, p []byte, ent zapcore.Entry) {
+			gotErr = err
+			gotP = append([]byte{}, p...)
+			gotEnt = ent
+		}),
+	)
+	defer async.Shutdown(context.Background())
+
+	ent := zapcore.Entry{Level: zapcore.WarnLevel, Message: "message"}
+	_, _ = async.Write([]byte("payload"), ent)
+	async.Drain(context.Background())
+
+	if !errors.Is(gotErr, chaos.ErrFailEnabled) {
+		t.Errorf("expected error %v, got %v", chaos.ErrFailEnabled, gotErr)
+	}
+	if string(gotP) != "payload" {
+		t.Errorf("expected payload %q, got %q", "payload", gotP)
+	}
+	if gotEnt != ent {
+		t.Errorf("expected entry %v, got %v", ent, gotEnt)
+	}
+}
+
+func TestAsync_OnWriteErrorForwardToFallback(t *testing.T) {
+	primary, primaryCounter := NewWriteCountingAppender()
+	failing := chaos.NewFailingSwitchable(primary)
+	fallback, fallbackCounter := NewWriteCountingAppender()
+
+	async, _ := appender.NewAsync(failing,
+		appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+		appender.AsyncOnWriteErrorForwardToFallback(),
+	)
+	defer async.Shutdown(context.Background())
+
+	Write(async)
+	async.Drain(context.Background())
+	AssertWrittenEquals(t, 1, primaryCounter, "primary before failing")
+	AssertWrittenEquals(t, 0, fallbackCounter, "fallback before failing")
+
+	failing.Break()
+	Write(async)
+	async.Drain(context.Background())
+	AssertWrittenEquals(t, 1, primaryCounter, "primary while failing")
+	AssertWrittenEquals(t, 1, fallbackCounter, "fallback while failing")
+}
+
+func TestAsync_OnWriteError_andForwardToFallback(t *testing.T) {
+	for _, reversed := range []bool{false, true} {
+		reversed := reversed
+		t.Run(fmt.Sprint("reversed ", reversed), func(t *testing.T) {
+			failing := chaos.NewFailingSwitchable(appender.NewDiscard())
+			failing.Break()
+			fallback, fallbackCounter := NewWriteCountingAppender()
+			var reported int32
+			options := AsyncOptions{
+				appender.AsyncOnWriteError(func(error, []byte, zapcore.Entry) { atomic.AddInt32(&reported, 1) }),
+				appender.AsyncOnWriteErrorForwardToFallback(),
+			}
+			if reversed {
+				options[0], options[1] = options[1], options[0]
+			}
+			async, err := appender.NewAsync(failing, append(options, appender.AsyncOnQueueNearlyFullForwardTo(fallback))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer async.Shutdown(context.Background())
+
+			Write(async)
+			async.Drain(context.Background())
+			if got := atomic.LoadInt32(&reported); got != 1 {
+				t.Errorf("expected the error to be reported once, got %d", got)
+			}
+			AssertWrittenEquals(t, 1, fallbackCounter, "fallback")
+		})
+	}
+}
+
+func TestAsync_Stats(t *testing.T) {
+	primary, _ := NewWriteCountingAppender()
+	blocking := chaos.NewBlockingSwitchable(primary)
+	blocking.Break()
+
+	async, _ := appender.NewAsync(blocking,
+		appender.AsyncOnQueueNearlyFullDropNewest(),
+		appender.AsyncMaxQueueLength(4),
+		appender.AsyncQueueMinFreeItems(1),
+	)
+	defer async.Shutdown(context.Background())
+
+	ent := zapcore.Entry{Time: time.Now()}
+	_, _ = async.Write([]byte{}, ent)
+	AwaitDequeued(async)
+	for i := 0; i < 5; i++ {
+		_, _ = async.Write([]byte{}, ent)
+	}
+
+	stats := async.Stats()
+	if stats.Enqueued != 4 || stats.Dropped != 2 || stats.Delivered != 0 {
+		t.Errorf("broken: unexpected counters %+v", stats)
+	}
+	if stats.QueueDepth != 3 || stats.QueueHighWater != 3 {
+		t.Errorf("broken: unexpected queue depth %+v", stats)
+	}
+
+	time.Sleep(time.Millisecond * 10) // the queued entries wait for the blocked one
+	blocking.Fix()
+	async.Drain(context.Background())
+
+	stats = async.Stats()
+	if stats.Enqueued != 4 || stats.Dropped != 2 || stats.Delivered != 4 {
+		t.Errorf("fixed: unexpected counters %+v", stats)
+	}
+	if stats.QueueDepth != 0 {
+		t.Errorf("fixed: unexpected queue depth %+v", stats)
+	}
+	if stats.WaitMax < time.Millisecond*10 || stats.PrimaryWriteMax <= 0 {
+		t.Errorf("fixed: unexpected durations %+v", stats)
+	}
+}
+
+// evictingOverflow is an OverflowStrategy evicting the oldest entries with outcome.
+type evictingOverflow struct {
+	outcome appender.DeliveryOutcome
+}
+
+func (evictingOverflow) Admit(zapcore.Entry) bool { return true }
+
+func (evictingOverflow) Evicts() bool { return true }
+
+func (s evictingOverflow) Evict([]byte, zapcore.Entry) appender.DeliveryOutcome { return s.outcome }
+
+func TestAsync_OnQueueNearlyFull(t *testing.T) {
+	tests := []struct {
+		name      string
+		outcome   appender.DeliveryOutcome
+		want      appender.DeliveryOutcome
+		wantStats func(s appender.AsyncStats) bool
+	}{
+		{name: "diverted", outcome: appender.DeliveryDiverted, want: appender.DeliveryDiverted,
+			wantStats: func(s appender.AsyncStats) bool { return s.Diverted > 0 && s.Dropped == 0 }},
+		{name: "dropped", outcome: appender.DeliveryDropped, want: appender.DeliveryDropped,
+			wantStats: func(s appender.AsyncStats) bool { return s.Dropped > 0 && s.Diverted == 0 }},
+		{name: "any other outcome is dropped", outcome: appender.DeliveryDelivered, want: appender.DeliveryDropped,
+			wantStats: func(s appender.AsyncStats) bool { return s.Dropped > 0 && s.Diverted == 0 }},
+	}
+	for _, tt := range tests {
+		outcome, want, wantStats := tt.outcome, tt.want, tt.wantStats
+		t.Run(tt.name, func(t *testing.T) {
+			blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+			blocking.Break()
+			defer blocking.Fix()
+			async, _ := appender.NewAsync(blocking,
+				appender.AsyncOnQueueNearlyFull(evictingOverflow{outcome: outcome}),
+				appender.AsyncMaxQueueLength(4),
+				appender.AsyncQueueMinFreeItems(1),
+			)
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+				defer cancel()
+				async.Shutdown(ctx)
+			}()
+
+			_, _ = async.Write([]byte("blocked"), zapcore.Entry{})
+			AwaitDequeued(async)
+			oldest, _ := async.WriteWithReceipt([]byte("oldest"), zapcore.Entry{})
+			for i := 0; i < 4; i++ {
+				_, _ = async.Write([]byte("newer"), zapcore.Entry{})
+			}
+
+			select {
+			case <-oldest.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("the oldest entry was not evicted")
+			}
+			if got := oldest.Outcome(); got != want {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+			if stats := async.Stats(); !wantStats(stats) {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestAsync_SpillTo_replaysSpilledEntriesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	spill, err := diskqueue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		_ = spill.Push([]byte(fmt.Sprint(i)), zapcore.Entry{})
+	}
+	_ = spill.Close()
+
+	spill, err = diskqueue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.Close()
+
+	var written []string
+	primary := appender.NewDelegating(func(p []byte, _ zapcore.Entry) (n int, err error) {
+		written = append(written, string(p))
+		return len(p), nil
+	}, nil, true)
+	async, _ := appender.NewAsync(primary, appender.AsyncOnQueueNearlyFullSpillTo(spill))
+	defer async.Shutdown(context.Background())
+
+	_, _ = async.Write([]byte("4"), zapcore.Entry{})
+	async.Drain(context.Background())
+
+	if fmt.Sprint(written) != "[1 2 3 4]" {
+		t.Errorf("expected spilled entries before queued ones, got %v", written)
+	}
+	if spill.Len() != 0 {
+		t.Errorf("expected an empty spill queue, got %d entries", spill.Len())
+	}
+}
+
+// sliceSpillQueue is a SpillQueue in memory whose entries with corrupt set cannot be read.
+type sliceSpillQueue struct {
+	mu      sync.Mutex
+	entries []string
+	corrupt map[string]bool
+}
+
+func (q *sliceSpillQueue) Push(p []byte, _ zapcore.Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = append(q.entries, string(p))
+	return nil
+}
+
+func (q *sliceSpillQueue) Peek() (p []byte, ent zapcore.Entry, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return nil, ent, false, nil
+	}
+	if q.corrupt[q.entries[0]] {
+		return nil, ent, false, errors.New("corrupt")
+	}
+	return []byte(q.entries[0]), ent, true, nil
+}
+
+func (q *sliceSpillQueue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = q.entries[1:]
+	return nil
+}
+
+func (q *sliceSpillQueue) Sync() error { return nil }
+
+func (q *sliceSpillQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func TestAsync_SpillTo_skipsUnreadableEntries(t *testing.T) {
+	spill := &sliceSpillQueue{entries: []string{"1", "2", "3"}, corrupt: map[string]bool{"2": true}}
+	primary, written := NewRecordingAppender()
+	async, _ := appender.NewAsync(primary, appender.AsyncOnQueueNearlyFullSpillTo(spill))
+	defer async.Shutdown(context.Background())
+
+	_, _ = async.Write([]byte("4"), zapcore.Entry{})
+	async.Drain(context.Background())
+
+	if fmt.Sprint(written()) != "[1 3 4]" {
+		t.Errorf("expected the unreadable entry to be skipped, got %v", written())
+	}
+	if spill.Len() != 0 {
+		t.Errorf("expected an empty spill queue, got %d entries", spill.Len())
+	}
+	stats := async.Stats()
+	if stats.SpillSkipped != 1 || stats.Dropped != 1 {
+		t.Errorf("expected 1 skipped and dropped entry, got %d skipped and %d dropped", stats.SpillSkipped, stats.Dropped)
+	}
+}
+
+func TestAsync_SpillTo_forwardsFailedReplayToFallback(t *testing.T) {
+	spill := &sliceSpillQueue{entries: []string{"1", "2"}}
+	primary := appender.NewDelegating(func(p []byte, _ zapcore.Entry) (n int, err error) {
+		return 0, errors.New("failed")
+	}, nil, true)
+	fallback, written := NewRecordingAppender()
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncFallback(fallback),
+		appender.AsyncOnQueueNearlyFullSpillTo(spill),
+		appender.AsyncOnWriteErrorForwardToFallback())
+	defer async.Shutdown(context.Background())
+
+	async.Drain(context.Background())
+
+	if fmt.Sprint(written()) != "[1 2]" {
+		t.Errorf("expected the spilled entries in the fallback, got %v", written())
+	}
+	if spill.Len() != 0 {
+		t.Errorf("expected an empty spill queue, got %d entries", spill.Len())
+	}
+	if stats := async.Stats(); stats.Failed != 2 || stats.Diverted != 2 {
+		t.Errorf("expected 2 failed and diverted entries, got %d failed and %d diverted", stats.Failed, stats.Diverted)
+	}
+}
+
+func TestAsync_SpillTo_reportsFailedReplay(t *testing.T) {
+	spill := &sliceSpillQueue{entries: []string{"1"}}
+	primary := appender.NewDelegating(func(p []byte, _ zapcore.Entry) (n int, err error) {
+		return 0, errors.New("failed")
+	}, nil, true)
+	reported := make(chan string, 1)
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncOnQueueNearlyFullSpillTo(spill),
+		appender.AsyncOnWriteError(func(err error, p []byte, _ zapcore.Entry) {
+			select {
+			case reported <- string(p):
+			default:
+			}
+		}))
+	defer func() {
+		// the entry is kept, so the spill queue is never drained
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		async.Shutdown(ctx)
+	}()
+
+	select {
+	case p := <-reported:
+		if p != "1" {
+			t.Errorf("expected the spilled entry to be reported, got %q", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed replay was not reported")
+	}
+	if spill.Len() != 1 {
+		t.Errorf("expected the entry to be kept for a retry, got %d entries", spill.Len())
+	}
+}
+
+func NewRecordingAppender() (appender.Appender, func() []string) {
+	var mu sync.Mutex
+	var written []string
+	writeFn := func(p []byte, _ zapcore.Entry) (n int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, string(p))
+		return len(p), nil
+	}
+	loadWrittenFn := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), written...)
+	}
+	return appender.NewDelegating(writeFn, nil, true), loadWrittenFn
+}
+
+func WriteLevel(a appender.Appender, p string, level zapcore.Level) {
+	_, _ = a.Write([]byte(p), zapcore.Entry{Level: level})
+}
+
+func TestAsync_LevelLanes(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      AsyncOptions
+		write        func(a appender.Appender)
+		wantPrimary  string
+		wantFallback string
+	}{
+		{name: "evicts lowest lane first",
+			options: AsyncOptions{
+				appender.AsyncLevelLanes(
+					appender.LevelLane{MinLevel: zapcore.ErrorLevel, Capacity: 2},
+					appender.LevelLane{MinLevel: zapcore.DebugLevel, Capacity: 4},
+				),
+				appender.AsyncQueueMinFreeItems(1),
+			},
+			write: func(a appender.Appender) {
+				for i := 1; i <= 4; i++ {
+					WriteLevel(a, fmt.Sprintf("d%d", i), zapcore.DebugLevel)
+				}
+				WriteLevel(a, "e1", zapcore.ErrorLevel)
+				WriteLevel(a, "e2", zapcore.ErrorLevel)
+			},
+			wantPrimary:  "[first e1 e2 d2 d3 d4]",
+			wantFallback: "[d1]",
+		},
+		{name: "serves skipped lower lane",
+			options: AsyncOptions{
+				appender.AsyncLevelLanes(
+					appender.LevelLane{MinLevel: zapcore.ErrorLevel, Capacity: 4},
+					appender.LevelLane{MinLevel: zapcore.DebugLevel, Capacity: 4},
+				),
+				appender.AsyncQueueMinFreeItems(0),
+				appender.AsyncLaneMaxSkips(2),
+			},
+			write: func(a appender.Appender) {
+				WriteLevel(a, "d1", zapcore.DebugLevel)
+				for i := 1; i <= 2; i++ {
+					WriteLevel(a, fmt.Sprintf("e%d", i), zapcore.ErrorLevel)
+				}
+				WriteLevel(a, "i1", zapcore.InfoLevel)
+				WriteLevel(a, "e3", zapcore.ErrorLevel)
+			},
+			wantPrimary:  "[first e1 e2 d1 e3 i1]",
+			wantFallback: "[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, primaryWritten := NewRecordingAppender()
+			blocking := chaos.NewBlockingSwitchable(primary)
+			blocking.Break()
+			fallback, fallbackWritten := NewRecordingAppender()
+
+			options := AsyncOptions{
+				appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+			}
+			async, _ := appender.NewAsync(blocking, append(options, tt.options...)...)
+			defer async.Shutdown(context.Background())
+
+			WriteLevel(async, "first", zapcore.DebugLevel)
+			AwaitDequeued(async)
+			tt.write(async)
+			time.Sleep(time.Millisecond * 10) // give monitor time to catch up
+
+			blocking.Fix()
+			async.Drain(context.Background())
+
+			if got := fmt.Sprint(primaryWritten()); got != tt.wantPrimary {
+				t.Errorf("primary: expected %s, got %s", tt.wantPrimary, got)
+			}
+			if got := fmt.Sprint(fallbackWritten()); got != tt.wantFallback {
+				t.Errorf("fallback: expected %s, got %s", tt.wantFallback, got)
+			}
+		})
+	}
+}
+
+func TestAsync_MaxQueueBytes(t *testing.T) {
+	payload := []byte("0123456789")
+	tests := []struct {
+		name    string
+		options AsyncOptions
+		write   int
+		broken  expectCounters
+		fixed   expectCounters
+	}{
+		{name: "evicts to keep min free bytes",
+			options: AsyncOptions{appender.AsyncQueueMinFreeBytes(20)},
+			write:   10,
+			broken:  expectCounters{primary: 0, fallback: 2}, // one is consumed by blocking
+			fixed:   expectCounters{primary: 8, fallback: 2},
+		},
+		{name: "blocks while bytes do not fit",
+			options: AsyncOptions{appender.AsyncQueueMinFreeBytes(0), appender.AsyncOnQueueNearlyFullBlock()},
+			write:   12,
+			broken:  expectCounters{primary: 0, fallback: 0, blocked: 1}, // one is consumed by blocking, 10 fit
+			fixed:   expectCounters{primary: 12, fallback: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, primaryCounter := NewWriteCountingAppender()
+			blocking := chaos.NewBlockingSwitchable(primary)
+			blocking.Break()
+			fallback, fallbackCounter := NewWriteCountingAppender()
+
+			options := AsyncOptions{
+				appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+				appender.AsyncMaxQueueLength(100),
+				appender.AsyncMaxQueueBytes(100),
+			}
+			async, _ := appender.NewAsync(blocking, append(options, tt.options...)...)
+			defer async.Shutdown(context.Background())
+
+			blocked := uint64(0)
+			actual := actualAccessors{
+				primary:  primaryCounter,
+				fallback: fallbackCounter,
+				blocked:  func() uint64 { return atomic.LoadUint64(&blocked) },
+				errors:   func() uint64 { return 0 },
+			}
+			write := tt.write
+			go func() {
+				for i := 0; i < write; i++ {
+					atomic.AddUint64(&blocked, 1)
+					_, _ = async.Write(payload, zapcore.Entry{})
+					atomic.AddUint64(&blocked, ^uint64(0))
+					if i == 0 {
+						AwaitDequeued(async)
+					}
+				}
+			}()
+
+			time.Sleep(time.Millisecond * 30) // give monitor time to catch up
+			AssertCounters(t, tt.broken, actual, "broken")
+
+			blocking.Fix()
+			time.Sleep(time.Millisecond * 10) // give monitor time to catch up
+			async.Drain(context.Background())
+			AssertCounters(t, tt.fixed, actual, "fixed")
+			if stats := async.Stats(); stats.QueueBytes != 0 {
+				t.Errorf("expected no queued bytes after drain, got %d", stats.QueueBytes)
+			}
+		})
+	}
+}
+
+func TestAsync_Shutdown_concurrentWrites(t *testing.T) {
+	primary, primaryCounter := NewWriteCountingAppender()
+	fallback, fallbackCounter := NewWriteCountingAppender()
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+		appender.AsyncOnQueueNearlyFullBlock(),
+		appender.AsyncMaxQueueLength(10),
+	)
+
+	var wg sync.WaitGroup
+	accepted := uint64(0)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := Write(async)
+				if errors.Is(err, appender.ErrAppenderShutdown) {
+					return
+				}
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				atomic.AddUint64(&accepted, 1)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	undelivered := async.Shutdown(ctx)
+	wg.Wait()
+
+	AssertWrittenEquals(t, uint64(undelivered), fallbackCounter, "fallback")
+	AssertWrittenEquals(t, atomic.LoadUint64(&accepted), func() uint64 {
+		return primaryCounter() + fallbackCounter()
+	}, "accepted")
+}
+
+func TestAsync_Shutdown_blockedPrimary_divertsQueuedAfterDeadline(t *testing.T) {
+	primary, primaryCounter := NewWriteCountingAppender()
+	blocking := chaos.NewBlockingSwitchable(primary)
+	blocking.Break()
+	defer blocking.Fix()
+	fallback, fallbackCounter := NewWriteCountingAppender()
+
+	async, _ := appender.NewAsync(blocking, appender.AsyncOnQueueNearlyFullForwardTo(fallback))
+	for i := 0; i < 5; i++ {
+		Write(async)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	undelivered := async.Shutdown(ctx)
+
+	if undelivered != 4 {
+		t.Errorf("expected 4 undelivered entries, got %d", undelivered) // one is consumed by blocking
+	}
+	AssertWrittenEquals(t, 0, primaryCounter, "primary")
+	AssertWrittenEquals(t, 4, fallbackCounter, "fallback")
+
+	if err := Write(async); !errors.Is(err, appender.ErrAppenderShutdown) {
+		t.Errorf("expected %v, got %v", appender.ErrAppenderShutdown, err)
+	}
+	async.Drain(context.Background()) // must not block after shutdown
+}
+
+func TestAsync_Shutdown_blockedFallback_returnsAfterDeadline(t *testing.T) {
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	defer blocking.Fix()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	// blocks the write of the entry that was not enqueued in time only
+	fallback := appender.NewDelegating(func(p []byte, _ zapcore.Entry) (n int, err error) {
+		if string(p) == "timed out" {
+			<-unblock
+		}
+		return len(p), nil
+	}, nil, true)
+
+	async, _ := appender.NewAsync(blocking,
+		appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+		appender.AsyncOnQueueNearlyFullBlock(),
+		appender.AsyncMaxQueueLength(1),
+		appender.AsyncEnqueueTimeout(time.Millisecond*10),
+		appender.AsyncOnEnqueueTimeoutForwardToFallback(),
+	)
+	_, _ = async.Write([]byte("blocked"), zapcore.Entry{})
+	AwaitDequeued(async)
+	_, _ = async.Write([]byte("queued"), zapcore.Entry{})
+	go func() {
+		_, _ = async.Write([]byte("timed out"), zapcore.Entry{})
+	}()
+	time.Sleep(time.Millisecond * 50) // the write times out and blocks in the fallback
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	shutdown := make(chan int, 1)
+	go func() { shutdown <- async.Shutdown(ctx) }()
+
+	select {
+	case undelivered := <-shutdown:
+		if undelivered != 1 {
+			t.Errorf("expected 1 undelivered entry, got %d", undelivered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown waits for the write blocked in the fallback beyond ctx")
+	}
+}
+
+// batchRecordingOut is a zapcore.WriteSyncer and appender.BatchWriter recording the batches.
+type batchRecordingOut struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (o *batchRecordingOut) Write(p []byte) (int, error) {
+	_, err := o.WriteBatch([][]byte{p})
+	return len(p), err
+}
+
+func (o *batchRecordingOut) WriteBatch(ps [][]byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	batch := make([]string, len(ps))
+	for i, p := range ps {
+		batch[i] = string(p)
+	}
+	o.batches = append(o.batches, batch)
+	return len(ps), nil
+}
+
+func (o *batchRecordingOut) Sync() error { return nil }
+
+func (o *batchRecordingOut) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return fmt.Sprint(o.batches)
+}
+
+func TestAsync_Batch_forwardsBatchesThroughAppenderChain(t *testing.T) {
+	out := &batchRecordingOut{}
+	var primary appender.Appender = appender.NewWriter(out)
+	primary = appender.NewFallback(primary, NewTestFailOnWriteAppender(t))
+	primary = appender.NewEnvelopingPreSuffix(primary, "<", ">")
+
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncBatchSize(3),
+		appender.AsyncBatchLinger(time.Second),
+	)
+	defer async.Shutdown(context.Background())
+
+	for i := 1; i <= 5; i++ {
+		_, _ = async.Write([]byte(fmt.Sprint(i)), zapcore.Entry{})
+	}
+	// the flush marker of Drain ends the lingering batch
+	async.Drain(context.Background())
+
+	if out.String() != "[[<1> <2> <3>] [<4> <5>]]" {
+		t.Errorf("unexpected batches %v", out)
+	}
+	if stats := async.Stats(); stats.Delivered != 5 {
+		t.Errorf("unexpected counters %+v", stats)
+	}
+}
+
+// failingBatchAppender writes the first entry of every batch and fails the others.
+type failingBatchAppender struct {
+	appender.Appender
+}
+
+func (a failingBatchAppender) WriteBatch(ps [][]byte, _ []zapcore.Entry) (int, error) {
+	return 1, errors.New("batch failed")
+}
+
+func TestAsync_Batch_reportsFailedEntries(t *testing.T) {
+	var failed []string
+	async, _ := appender.NewAsync(failingBatchAppender{appender.NewDiscard()},
+		appender.AsyncBatchSize(64),
+		appender.AsyncBatchLinger(time.Second),
+		appender.AsyncOnWriteError(func(err error, p []byte, ent zapcore.Entry) {
+			failed = append(failed, string(p))
+		}),
+	)
+	defer async.Shutdown(context.Background())
+
+	for i := 1; i <= 3; i++ {
+		_, _ = async.Write([]byte(fmt.Sprint(i)), zapcore.Entry{})
+	}
+	async.Drain(context.Background())
+
+	if fmt.Sprint(failed) != "[2 3]" {
+		t.Errorf("expected the entries after the first one to fail, got %v", failed)
+	}
+	if stats := async.Stats(); stats.Delivered != 1 || stats.Failed != 2 {
+		t.Errorf("unexpected counters %+v", stats)
+	}
+}
+
+func TestAsync_ForwardingWorkers_writeInParallel(t *testing.T) {
+	workers := 4
+	var writing int32
+	release := make(chan struct{})
+	primary := appender.NewDelegating(func(p []byte, _ zapcore.Entry) (int, error) {
+		if atomic.AddInt32(&writing, 1) == int32(workers) {
+			close(release)
+		}
+		select {
+		case <-release:
+		case <-time.After(time.Second):
+			return 0, errors.New("writes were not in parallel")
+		}
+		return len(p), nil
+	}, nil, true)
+
+	async, _ := appender.NewAsync(primary, appender.AsyncForwardingWorkers(workers))
+	defer async.Shutdown(context.Background())
+
+	for i := 0; i < workers; i++ {
+		Write(async)
+	}
+	async.Drain(context.Background())
+
+	if stats := async.Stats(); stats.Delivered != uint64(workers) {
+		t.Errorf("unexpected counters %+v", stats)
+	}
+}
+
+func TestAsync_ForwardingWorkersByKey_keepOrderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	written := map[string][]int{}
+	primary := appender.NewDelegating(func(p []byte, ent zapcore.Entry) (int, error) {
+		var i int
+		_, _ = fmt.Sscan(string(p), &i)
+		time.Sleep(time.Duration(i%3) * time.Microsecond * 100)
+		mu.Lock()
+		defer mu.Unlock()
+		written[ent.LoggerName] = append(written[ent.LoggerName], i)
+		return len(p), nil
+	}, nil, true)
+
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncForwardingWorkersByKey(4, appender.PartitionByLoggerName),
+		appender.AsyncOnQueueNearlyFullBlock(),
+	)
+	defer async.Shutdown(context.Background())
+
+	loggers := []string{"a", "b", "c", "d", "e"}
+	count := 50
+	for i := 0; i < count; i++ {
+		for _, logger := range loggers {
+			_, _ = async.Write([]byte(fmt.Sprint(i)), zapcore.Entry{LoggerName: logger})
+		}
+	}
+	async.Drain(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, logger := range loggers {
+		entries := written[logger]
+		if len(entries) != count {
+			t.Errorf("logger %s: expected %d entries, got %d", logger, count, len(entries))
+			continue
+		}
+		for i, entry := range entries {
+			if entry != i {
+				t.Errorf("logger %s: out of order at %d: %v", logger, i, entries)
+				break
+			}
+		}
+	}
+}
+
+func TestAsync_ForwardingWorkersByKey_blockedKeyDoesNotStallOtherKeys(t *testing.T) {
+	unblock := make(chan struct{})
+	var delivered int32
+	primary := appender.NewDelegating(func(p []byte, ent zapcore.Entry) (int, error) {
+		if ent.LoggerName == "slow" {
+			<-unblock
+			return len(p), nil
+		}
+		atomic.AddInt32(&delivered, 1)
+		return len(p), nil
+	}, nil, true)
+
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncForwardingWorkersByKey(8, appender.PartitionByLoggerName),
+		appender.AsyncOnQueueNearlyFullBlock(),
+	)
+	defer close(unblock)
+
+	for i := 0; i < 3; i++ {
+		_, _ = async.Write([]byte("slow"), zapcore.Entry{LoggerName: "slow"})
+	}
+	// the keys map to other workers than slow
+	loggers := []string{"a", "b", "c", "d", "f", "g"}
+	for _, logger := range loggers {
+		_, _ = async.Write([]byte(logger), zapcore.Entry{LoggerName: logger})
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&delivered) < int32(len(loggers)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&delivered); got != int32(len(loggers)) {
+		t.Errorf("expected the entries of the other loggers to be delivered, got %d of %d", got, len(loggers))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	// the first slow entry is written, the others wait in the queue of its worker
+	if undelivered := async.Shutdown(ctx); undelivered != 2 {
+		t.Errorf("expected 2 undelivered entries, got %d", undelivered)
+	}
+}
+
+func TestAsync_Overflow_evictsWithoutWaitingForMonitorPeriod(t *testing.T) {
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	defer blocking.Fix()
+
+	async, _ := appender.NewAsync(blocking,
+		appender.AsyncOnQueueNearlyFullDropOldest(),
+		appender.AsyncMaxQueueLength(10),
+	)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		async.Shutdown(ctx)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			Write(async)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked until the next monitor period")
+	}
+	if stats := async.Stats(); stats.Dropped < 80 {
+		t.Errorf("expected the overflow to be evicted, got %+v", stats)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		Write(async)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations per Write, got %v", allocs)
+	}
+}
+
+func TestAsync_EnqueueTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      AsyncOptions
+		wantErr      error
+		wantFallback uint64
+		wantDropped  uint64
+	}{
+		{name: "returns error", wantErr: appender.ErrEnqueueTimeout, wantDropped: 1},
+		{name: "forwards to fallback",
+			options:      AsyncOptions{appender.AsyncOnEnqueueTimeoutForwardToFallback()},
+			wantFallback: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+			blocking.Break()
+			defer blocking.Fix()
+			fallback, fallbackCounter := NewWriteCountingAppender()
+
+			async, _ := appender.NewAsync(blocking, append(AsyncOptions{
+				appender.AsyncOnQueueNearlyFullBlock(),
+				appender.AsyncFallback(fallback),
+				appender.AsyncMaxQueueLength(1),
+				appender.AsyncEnqueueTimeout(time.Millisecond * 10),
+			}, tt.options...)...)
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+				defer cancel()
+				async.Shutdown(ctx)
+			}()
+
+			Write(async)
+			AwaitDequeued(async)
+			Write(async)
+
+			start := time.Now()
+			err := Write(async)
+			if elapsed := time.Since(start); elapsed < time.Millisecond*10 || elapsed > time.Second {
+				t.Errorf("expected Write to wait for the timeout, waited %v", elapsed)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+			AssertWrittenEquals(t, tt.wantFallback, fallbackCounter, "fallback")
+			if stats := async.Stats(); stats.Dropped != tt.wantDropped || stats.Diverted != tt.wantFallback {
+				t.Errorf("unexpected counters %+v", stats)
+			}
+		})
+	}
+}
+
+func TestAsync_WriteWithReceipt(t *testing.T) {
+	failing := appender.NewDelegating(func(p []byte, _ zapcore.Entry) (int, error) {
+		return 0, errors.New("failed")
+	}, nil, true)
+	tests := []struct {
+		name    string
+		primary appender.Appender
+		options AsyncOptions
+		want    appender.DeliveryOutcome
+		wantErr bool
+	}{
+		{name: "delivered", primary: appender.NewDiscard(), want: appender.DeliveryDelivered},
+		{name: "failed", primary: failing, want: appender.DeliveryFailed, wantErr: true},
+		{name: "failed and forwarded",
+			primary: failing,
+			options: AsyncOptions{
+				appender.AsyncOnQueueNearlyFullForwardTo(appender.NewDiscard()),
+				appender.AsyncOnWriteErrorForwardToFallback(),
+			},
+			want:    appender.DeliveryDiverted,
+			wantErr: true,
+		},
+		{name: "dropped",
+			primary: appender.NewDiscard(),
+			options: AsyncOptions{
+				appender.AsyncOnQueueNearlyFullDropNewest(),
+				appender.AsyncMaxQueueLength(1),
+				appender.AsyncQueueMinFreeItems(1),
+			},
+			want: appender.DeliveryDropped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			async, _ := appender.NewAsync(tt.primary, tt.options...)
+			defer async.Shutdown(context.Background())
+
+			receipt, err := async.WriteWithReceipt([]byte("audit"), zapcore.Entry{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			outcome, err := receipt.Wait(ctx)
+			if outcome != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("expected %v, got %v with error %v", tt.want, outcome, err)
+			}
+		})
+	}
+}
+
+func TestAsync_WriteWithReceipt_resolvesQueuedEntriesOnShutdown(t *testing.T) {
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	defer blocking.Fix()
+	async, _ := appender.NewAsync(blocking)
+
+	Write(async) // blocks the forwarder
+	receipt, err := async.WriteWithReceipt([]byte("audit"), zapcore.Entry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-receipt.Done():
+		t.Fatal("resolved before delivery")
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	async.Shutdown(ctx)
+
+	if outcome, _ := receipt.Wait(context.Background()); outcome != appender.DeliveryDiverted {
+		t.Errorf("expected %v, got %v", appender.DeliveryDiverted, outcome)
+	}
+	if _, err := async.WriteWithReceipt([]byte("audit"), zapcore.Entry{}); !errors.Is(err, appender.ErrAppenderShutdown) {
+		t.Errorf("expected %v, got %v", appender.ErrAppenderShutdown, err)
+	}
+}
+
+func TestAsync_Resize_keepsQueuedMessagesInOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      AsyncOptions
+		write        func(t *testing.T, a *appender.Async)
+		wantPrimary  string
+		wantFallback string
+	}{
+		{name: "grow",
+			options: AsyncOptions{appender.AsyncQueueMinFreeItems(0)},
+			write: func(t *testing.T, a *appender.Async) {
+				if err := a.Resize(context.Background(), 8); err != nil {
+					t.Fatal(err)
+				}
+				for i := 5; i <= 8; i++ {
+					WriteLevel(a, fmt.Sprintf("m%d", i), zapcore.InfoLevel)
+				}
+			},
+			wantPrimary:  "[first m1 m2 m3 m4 m5 m6 m7 m8]",
+			wantFallback: "[]",
+		},
+		{name: "shrink",
+			options: AsyncOptions{appender.AsyncQueueMinFreeItems(0), appender.AsyncOnQueueNearlyFullBlock()},
+			write: func(t *testing.T, a *appender.Async) {
+				if err := a.Resize(context.Background(), 2); err != nil {
+					t.Fatal(err)
+				}
+				// the replaced queue must be drained before the next resize
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+				defer cancel()
+				if err := a.Resize(ctx, 3); !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+				}
+			},
+			wantPrimary:  "[first m1 m2 m3 m4]",
+			wantFallback: "[]",
+		},
+		{name: "shrink below the queued messages evicts",
+			options: AsyncOptions{appender.AsyncQueueMinFreeItems(0)},
+			write: func(t *testing.T, a *appender.Async) {
+				if err := a.Resize(context.Background(), 2); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(time.Millisecond * 10) // give monitor time to catch up
+			},
+			wantPrimary:  "[first m3 m4]",
+			wantFallback: "[m1 m2]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, primaryWritten := NewRecordingAppender()
+			blocking := chaos.NewBlockingSwitchable(primary)
+			blocking.Break()
+			fallback, fallbackWritten := NewRecordingAppender()
+
+			options := AsyncOptions{
+				appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+				appender.AsyncMaxQueueLength(4),
+			}
+			async, _ := appender.NewAsync(blocking, append(options, tt.options...)...)
+			defer async.Shutdown(context.Background())
+
+			WriteLevel(async, "first", zapcore.InfoLevel)
+			AwaitDequeued(async)
+			for i := 1; i <= 4; i++ {
+				WriteLevel(async, fmt.Sprintf("m%d", i), zapcore.InfoLevel)
+			}
+			tt.write(t, async)
+
+			blocking.Fix()
+			async.Drain(context.Background())
+
+			if got := fmt.Sprint(primaryWritten()); got != tt.wantPrimary {
+				t.Errorf("primary: expected %s, got %s", tt.wantPrimary, got)
+			}
+			if got := fmt.Sprint(fallbackWritten()); got != tt.wantFallback {
+				t.Errorf("fallback: expected %s, got %s", tt.wantFallback, got)
+			}
+		})
+	}
+}
+
+func TestAsync_Resize_concurrentWrites(t *testing.T) {
+	primary, written := NewWriteCountingAppender()
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncMaxQueueLength(4),
+		appender.AsyncOnQueueNearlyFullBlock(),
+	)
+	defer async.Shutdown(context.Background())
+
+	const writers, writes = 4, 500
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				Write(async)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for length := 1; ; length = length%64 + 1 {
+		select {
+		case <-done:
+			async.Drain(context.Background())
+			AssertWrittenEquals(t, writers*writes, written, "all messages are written")
+			return
+		default:
+		}
+		if err := async.Resize(context.Background(), length); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAsync_Resize_concurrentSync(t *testing.T) {
+	async, _ := appender.NewAsync(appender.NewDiscard(),
+		appender.AsyncMaxQueueLength(4),
+		appender.AsyncOnQueueNearlyFullBlock(),
+	)
+	defer async.Shutdown(context.Background())
+
+	const syncers, syncs = 4, 1000
+	var wg sync.WaitGroup
+	wg.Add(syncers)
+	for i := 0; i < syncers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < syncs; j++ {
+				_ = async.Sync()
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	deadline := time.After(10 * time.Second)
+	for length := 1; ; length = length%64 + 1 {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			t.Fatal("Sync blocks, its flush marker was pushed to a dropped ring")
+		default:
+		}
+		if err := async.Resize(context.Background(), length); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAsync_Resize_recalculatesThreshold(t *testing.T) {
+	async, _ := appender.NewAsync(appender.NewDiscard(),
+		appender.AsyncMaxQueueLength(10),
+		appender.AsyncQueueMinFreeItems(5),
+	)
+	defer async.Shutdown(context.Background())
+
+	if err := async.Resize(context.Background(), 4); err == nil {
+		t.Error("expected the min free items to exceed the max queue length")
+	}
+	if err := async.Resize(context.Background(), 4, appender.AsyncQueueMinFreePercent(.5)); err != nil {
+		t.Error(err)
+	}
+	if err := async.Resize(context.Background(), -1); err == nil {
+		t.Error("expected an error for a negative length")
+	}
+	async.Shutdown(context.Background())
+	if err := async.Resize(context.Background(), 10); !errors.Is(err, appender.ErrAppenderShutdown) {
+		t.Errorf("expected %v, got %v", appender.ErrAppenderShutdown, err)
+	}
+}
+
+func TestAsync_MemoryBudget_reservationsProtectQuietAppenders(t *testing.T) {
+	budget, _ := appender.NewMemoryBudget(1000)
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	defer blocking.Fix()
+
+	noisy, err := appender.NewAsync(blocking,
+		appender.AsyncMemoryBudget(budget, 200), appender.AsyncOnQueueNearlyFullDropNewest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet, err := appender.NewAsync(blocking,
+		appender.AsyncMemoryBudget(budget, 200), appender.AsyncOnQueueNearlyFullDropNewest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		noisy.Shutdown(ctx)
+		quiet.Shutdown(ctx)
+	}()
+
+	p := make([]byte, 50)
+	for i := 0; i < 100; i++ {
+		_, _ = noisy.Write(p, zapcore.Entry{})
+	}
+	for i := 0; i < 4; i++ {
+		_, _ = quiet.Write(p, zapcore.Entry{})
+	}
+
+	// the noisy appender takes its reservation and all shared bytes
+	if stats := noisy.Stats(); stats.Enqueued != 16 || stats.Dropped != 84 {
+		t.Errorf("noisy: expected 16 enqueued and 84 dropped, got %+v", stats)
+	}
+	if stats := quiet.Stats(); stats.Enqueued != 4 || stats.Dropped != 0 {
+		t.Errorf("quiet: expected 4 enqueued and none dropped, got %+v", stats)
+	}
+	if used := budget.Used(); used != 1000 {
+		t.Errorf("expected the budget to be used up, got %d", used)
+	}
+}
+
+func TestAsync_MemoryBudget_reservation(t *testing.T) {
+	budget, _ := appender.NewMemoryBudget(1000)
+	first, err := appender.NewAsync(appender.NewDiscard(), appender.AsyncMemoryBudget(budget, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appender.NewAsync(appender.NewDiscard(), appender.AsyncMemoryBudget(budget, 600)); err == nil {
+		t.Error("expected the reservation to exceed the budget")
+	}
+	first.Shutdown(context.Background())
+	second, err := appender.NewAsync(appender.NewDiscard(), appender.AsyncMemoryBudget(budget, 600))
+	if err != nil {
+		t.Errorf("expected Shutdown to return the reservation, got %v", err)
+	} else {
+		second.Shutdown(context.Background())
+	}
+}
+
+func TestAsync_WorkerPool_drivesManyAppenders(t *testing.T) {
+	pool, _ := appender.NewWorkerPool(2)
+	defer pool.Close()
+
+	goroutines := runtime.NumGoroutine()
+	const appenders, writes = 50, 100
+	asyncs := make([]*appender.Async, appenders)
+	counters := make([]func() uint64, appenders)
+	for i := range asyncs {
+		var primary appender.Appender
+		primary, counters[i] = NewWriteCountingAppender()
+		asyncs[i], _ = appender.NewAsync(primary,
+			appender.AsyncWorkerPool(pool),
+			appender.AsyncOnQueueNearlyFullDropOldest(),
+		)
+	}
+	if started := runtime.NumGoroutine() - goroutines; started > 0 {
+		t.Errorf("expected the appenders to start no goroutines, got %d", started)
+	}
+
+	for i := 0; i < writes; i++ {
+		for _, async := range asyncs {
+			Write(async)
+		}
+	}
+	for i, async := range asyncs {
+		async.Drain(context.Background())
+		AssertWrittenEquals(t, writes, counters[i], fmt.Sprintf("appender %d", i))
+		async.Shutdown(context.Background())
+	}
+}
+
+func TestAsync_WorkerPool_servesAppendersInTurns(t *testing.T) {
+	pool, _ := appender.NewWorkerPool(1)
+	defer pool.Close()
+
+	primary, written := NewRecordingAppender()
+	blocking := chaos.NewBlockingSwitchable(primary)
+	blocking.Break()
+	busy, _ := appender.NewAsync(blocking, appender.AsyncWorkerPool(pool), appender.AsyncBatchSize(1))
+	defer busy.Shutdown(context.Background())
+	quiet, _ := appender.NewAsync(primary, appender.AsyncWorkerPool(pool))
+	defer quiet.Shutdown(context.Background())
+
+	WriteLevel(busy, "busy", zapcore.InfoLevel)
+	time.Sleep(time.Millisecond * 10) // the only worker blocks in the turn of busy
+	for i := 0; i < 200; i++ {
+		WriteLevel(busy, "busy", zapcore.InfoLevel)
+	}
+	WriteLevel(quiet, "quiet", zapcore.InfoLevel)
+
+	blocking.Fix()
+	busy.Drain(context.Background())
+	quiet.Drain(context.Background())
+
+	got := written()
+	for i, p := range got {
+		if p == "quiet" {
+			if i > 64 {
+				t.Errorf("expected quiet to be served after a turn of busy, got position %d", i)
+			}
+			return
+		}
+	}
+	t.Errorf("quiet was not written: %v", got)
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func (c fixedClock) NewTicker(d time.Duration) *time.Ticker { return time.NewTicker(d) }
+
+func TestAsync_MaxAge(t *testing.T) {
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	annotate := func(p []byte, _ zapcore.Entry, age time.Duration, output *buffer.Buffer) error {
+		output.AppendString(fmt.Sprintf("stale(%s) ", age))
+		_, err := output.Write(p)
+		return err
+	}
+	tests := []struct {
+		name         string
+		option       appender.AsyncOption
+		wantPrimary  string
+		wantFallback string
+		wantStats    func(s appender.AsyncStats) bool
+	}{
+		{name: "drop",
+			option:       appender.AsyncOnStaleDrop(time.Minute),
+			wantPrimary:  "[fresh]",
+			wantFallback: "[]",
+			wantStats: func(s appender.AsyncStats) bool {
+				return s.StaleDropped == 1 && s.Dropped == 1 && s.Delivered == 1
+			},
+		},
+		{name: "forward to fallback",
+			option:       appender.AsyncOnStaleForwardToFallback(time.Minute),
+			wantPrimary:  "[fresh]",
+			wantFallback: "[stale]",
+			wantStats: func(s appender.AsyncStats) bool {
+				return s.StaleDiverted == 1 && s.Diverted == 1 && s.Delivered == 1
+			},
+		},
+		{name: "annotate",
+			option:       appender.AsyncOnStaleAnnotate(time.Minute, annotate),
+			wantPrimary:  "[stale(2m0s) stale fresh]",
+			wantFallback: "[]",
+			wantStats: func(s appender.AsyncStats) bool {
+				return s.StaleAnnotated == 1 && s.Delivered == 2
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, spilled := range []bool{false, true} {
+			name := tt.name
+			if spilled {
+				name += " spilled"
+			}
+			option, wantPrimary, wantFallback, wantStats := tt.option, tt.wantPrimary, tt.wantFallback, tt.wantStats
+			t.Run(name, func(t *testing.T) {
+				primary, primaryWritten := NewRecordingAppender()
+				fallback, fallbackWritten := NewRecordingAppender()
+				options := []appender.AsyncOption{
+					appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+					appender.AsyncClock(fixedClock(now)),
+					option,
+				}
+				stale := zapcore.Entry{Time: now.Add(-2 * time.Minute)}
+				fresh := zapcore.Entry{Time: now.Add(-time.Minute)}
+				if spilled {
+					spill, err := diskqueue.Open(t.TempDir())
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer spill.Close()
+					_ = spill.Push([]byte("stale"), stale)
+					_ = spill.Push([]byte("fresh"), fresh)
+					options = append(options, appender.AsyncOnQueueNearlyFullSpillTo(spill))
+				}
+				async, _ := appender.NewAsync(primary, options...)
+				defer async.Shutdown(context.Background())
+
+				if !spilled {
+					_, _ = async.Write([]byte("stale"), stale)
+					_, _ = async.Write([]byte("fresh"), fresh)
+				}
+				async.Drain(context.Background())
+
+				if got := fmt.Sprint(primaryWritten()); got != wantPrimary {
+					t.Errorf("primary: expected %s, got %s", wantPrimary, got)
+				}
+				if got := fmt.Sprint(fallbackWritten()); got != wantFallback {
+					t.Errorf("fallback: expected %s, got %s", wantFallback, got)
+				}
+				stats := async.Stats()
+				if !wantStats(stats) {
+					t.Errorf("unexpected stats %+v", stats)
+				}
+				if !spilled && (stats.WaitTotal != 3*time.Minute || stats.WaitMax != 2*time.Minute) {
+					t.Errorf("expected the wait measured with the clock, got total %s max %s", stats.WaitTotal, stats.WaitMax)
+				}
+			})
+		}
+	}
+}
+
+// NewSequenceRecordingAppender records the sequence numbers of the entries written to inner.
+func NewSequenceRecordingAppender(inner appender.Appender) (appender.Appender, func() []uint64) {
+	var mu sync.Mutex
+	var written []uint64
+	recording := appender.NewSequencedEnveloping(inner,
+		func(_ []byte, _ zapcore.Entry, seq uint64, _ *buffer.Buffer) error {
+			mu.Lock()
+			defer mu.Unlock()
+			written = append(written, seq)
+			return nil
+		})
+	loadWrittenFn := func() []uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uint64(nil), written...)
+	}
+	return recording, loadWrittenFn
+}
+
+func AssertAscending(t *testing.T, seqs []uint64, msg string) {
+	t.Helper()
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] <= seqs[i-1] {
+			t.Errorf("%s: sequence %d after %d at %d", msg, seqs[i], seqs[i-1], i)
+			return
+		}
+	}
+}
+
+func TestAsync_SequenceNumbers_keepOrderPerDestination(t *testing.T) {
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	primary, primaryWritten := NewSequenceRecordingAppender(blocking)
+	fallback, fallbackWritten := NewSequenceRecordingAppender(appender.NewDiscard())
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncSequenceNumbers(),
+		appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+		appender.AsyncMaxQueueLength(8),
+		appender.AsyncQueueMinFreeItems(2),
+	)
+	defer async.Shutdown(context.Background())
+
+	const writers, writes = 4, 50
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				Write(async)
+			}
+		}()
+	}
+	wg.Wait()
+	blocking.Fix()
+	async.Drain(context.Background())
+
+	gotPrimary, gotFallback := primaryWritten(), fallbackWritten()
+	AssertAscending(t, gotPrimary, "primary")
+	AssertAscending(t, gotFallback, "fallback")
+	if len(gotFallback) == 0 {
+		t.Error("expected the queue to overflow to the fallback")
+	}
+	if got := len(gotPrimary) + len(gotFallback); got != writers*writes {
+		t.Errorf("expected %d entries, got %d", writers*writes, got)
+	}
+}
+
+func TestAsync_SequenceNumbers_dropsEntriesOutOfOrder(t *testing.T) {
+	failing := chaos.NewFailingSwitchable(appender.NewDiscard())
+	blocking := chaos.NewBlockingSwitchable(failing)
+	blocking.Break()
+	primary, primaryWritten := NewSequenceRecordingAppender(blocking)
+	fallback, fallbackWritten := NewSequenceRecordingAppender(appender.NewDiscard())
+	async, _ := appender.NewAsync(primary,
+		appender.AsyncSequenceNumbers(),
+		appender.AsyncOnQueueNearlyFullForwardTo(fallback),
+		appender.AsyncOnWriteErrorForwardToFallback(),
+		appender.AsyncMaxQueueLength(4),
+		appender.AsyncQueueMinFreeItems(1),
+	)
+	defer async.Shutdown(context.Background())
+
+	Write(async) // blocks the forwarder
+	time.Sleep(time.Millisecond * 10)
+	for i := 0; i < 5; i++ {
+		Write(async)
+	}
+	time.Sleep(time.Millisecond * 10) // give monitor time to catch up
+	// the first entry fails after later ones were evicted to the fallback
+	failing.Break()
+	blocking.Fix()
+	async.Drain(context.Background())
+
+	if got := fmt.Sprint(fallbackWritten()); got != "[2 3 4 5 6]" {
+		t.Errorf("fallback: expected [2 3 4 5 6], got %s", got)
+	}
+	if got := fmt.Sprint(primaryWritten()); got != "[1 4 5 6]" {
+		t.Errorf("primary: expected the attempts [1 4 5 6], got %s", got)
+	}
+	if stats := async.Stats(); stats.OutOfOrder != 1 {
+		t.Errorf("expected 1 entry out of order, got %+v", stats)
+	}
+}
+
+func TestAsync_Emergency_flushesQueueBeforeReturning(t *testing.T) {
+	primary, primaryCounter := NewWriteCountingAppender()
+	emergency, emergencyWritten := NewRecordingAppender()
+	async, _ := appender.NewAsync(primary, appender.AsyncEmergency(zapcore.DPanicLevel, emergency, time.Second))
+	defer async.Shutdown(context.Background())
+
+	for i := 0; i < 10; i++ {
+		WriteLevel(async, "queued", zapcore.ErrorLevel)
+	}
+	WriteLevel(async, "emergency", zapcore.FatalLevel)
+
+	AssertWrittenEquals(t, 10, primaryCounter, "primary")
+	if got := fmt.Sprint(emergencyWritten()); got != "[emergency]" {
+		t.Errorf("expected the emergency entry, got %s", got)
+	}
+	if stats := async.Stats(); stats.Emergency != 1 || stats.Enqueued != 10 {
+		t.Errorf("expected 1 emergency entry and 10 enqueued entries, got %+v", stats)
+	}
+}
+
+func TestAsync_Emergency_laterSyncDrainsQueue(t *testing.T) {
+	primary, primaryCounter := NewWriteCountingAppender()
+	blocking := chaos.NewBlockingSwitchable(primary)
+	emergency, _ := NewRecordingAppender()
+	async, _ := appender.NewAsync(blocking, appender.AsyncEmergency(zapcore.DPanicLevel, emergency, time.Second))
+	defer async.Shutdown(context.Background())
+
+	// not followed by Sync as written to the appender directly
+	WriteLevel(async, "emergency", zapcore.FatalLevel)
+
+	blocking.Break()
+	for i := 0; i < 5; i++ {
+		Write(async)
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		blocking.Fix()
+	}()
+	if err := async.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	AssertWrittenEquals(t, 5, primaryCounter, "primary after Sync")
+}
+
+func TestAsync_Emergency_enqueuedWhileDraining_laterSyncDrainsQueue(t *testing.T) {
+	primary, primaryCounter := NewWriteCountingAppender()
+	blocking := chaos.NewBlockingSwitchable(primary)
+	blocking.Break()
+	emergency, _ := NewRecordingAppender()
+	async, _ := appender.NewAsync(blocking, appender.AsyncEmergency(zapcore.DPanicLevel, emergency, time.Millisecond*100))
+	defer async.Shutdown(context.Background())
+
+	Write(async)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// drains until the deadline as the primary is blocked
+		WriteLevel(async, "emergency", zapcore.FatalLevel)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	for i := 0; i < 4; i++ {
+		Write(async)
+	}
+	<-done
+
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		blocking.Fix()
+	}()
+	if err := async.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	AssertWrittenEquals(t, 5, primaryCounter, "primary after Sync")
+}
+
+func TestAsync_Emergency_blockedPrimary_returnsAfterDeadline(t *testing.T) {
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	emergency, emergencyWritten := NewRecordingAppender()
+	async, _ := appender.NewAsync(blocking, appender.AsyncEmergency(zapcore.DPanicLevel, emergency, time.Millisecond*20))
+	defer async.Shutdown(context.Background())
+	defer blocking.Fix()
+	core := appender.NewAppenderCore(zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}), async, zapcore.DebugLevel)
+
+	for i := 0; i < 5; i++ {
+		Write(async)
+	}
+	start := time.Now()
+	// syncs as the level is above error
+	if err := core.Write(zapcore.Entry{Level: zapcore.PanicLevel, Message: "panic"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected the write to return after the emergency deadline, took %s", elapsed)
+	}
+	if got := fmt.Sprint(emergencyWritten()); got != "[{\"msg\":\"panic\"}\n]" {
+		t.Errorf("expected the panic entry, got %s", got)
+	}
+}
@@ -0,0 +1,52 @@
+package appender
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrEnqueueTimeout is returned by Async.Write if the message could not be enqueued
+// within the timeout set by AsyncEnqueueTimeout.
+var ErrEnqueueTimeout = errors.New("enqueue timed out")
+
+// enqueueWait bounds how long an enqueue waits for space.
+// The timer is only started once the enqueue has to wait, so the fast path does not allocate.
+type enqueueWait struct {
+	done    <-chan struct{} // e.g. the context of Drain
+	closed  <-chan struct{}
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// expired returns the channel of the timeout, starting the timer on the first call.
+// Without a timeout it returns nil, which never fires.
+func (w *enqueueWait) expired() <-chan time.Time {
+	if w.timeout <= 0 {
+		return nil
+	}
+	if w.timer == nil {
+		w.timer = time.NewTimer(w.timeout)
+	}
+	return w.timer.C
+}
+
+// wait blocks until signal fires.
+// It returns ErrAppenderShutdown if done or closed fire and ErrEnqueueTimeout if the timeout expired.
+func (w *enqueueWait) wait(signal <-chan struct{}) error {
+	select {
+	case <-signal:
+		return nil
+	case <-w.done:
+		return ErrAppenderShutdown
+	case <-w.closed:
+		return ErrAppenderShutdown
+	case <-w.expired():
+		return ErrEnqueueTimeout
+	}
+}
+
+func (w *enqueueWait) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
@@ -0,0 +1,150 @@
+package appender
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// PartitionKeyFn returns the key of ent.
+// Entries with the same key are written by the same worker in queue order.
+type PartitionKeyFn func(ent zapcore.Entry) string
+
+// PartitionByLoggerName keeps the order of the entries of every logger.
+func PartitionByLoggerName(ent zapcore.Entry) string {
+	return ent.LoggerName
+}
+
+// workerQueueLength is the number of messages a partitioned worker buffers.
+const workerQueueLength = 64
+
+// startWorkers starts the forwarding workers if more than one is configured.
+// The forwarding routine then dispatches the messages to them instead of writing them itself.
+// Unordered workers share a single queue; partitioned workers own one queue each.
+func (a *Async) startWorkers() {
+	if a.workerCount <= 1 {
+		return
+	}
+	queues := 1
+	if a.partitionKeyFn != nil {
+		queues = a.workerCount
+	}
+	a.workQueues = make([]chan writeMessage, queues)
+	for i := range a.workQueues {
+		if a.partitionKeyFn == nil {
+			// unbuffered, so messages wait in the lanes, where the overflow strategy handles them
+			a.workQueues[i] = make(chan writeMessage)
+			continue
+		}
+		// buffered, so a blocked write only stalls the dispatching once the queue of its worker is full
+		a.workQueues[i] = make(chan writeMessage, workerQueueLength)
+	}
+	a.workersDone.Add(a.workerCount)
+	for i := 0; i < a.workerCount; i++ {
+		go a.work(a.workQueues[i%queues])
+	}
+}
+
+// dispatch hands msg to a worker.
+// It blocks until the worker takes msg, or its queue has space, or the appender is shut down,
+// in which case msg is written to the fallback.
+func (a *Async) dispatch(msg writeMessage) {
+	queue := a.workQueues[0]
+	if a.partitionKeyFn != nil {
+		queue = a.workQueues[partition(a.partitionKeyFn(msg.ent), len(a.workQueues))]
+	}
+	a.inflight.Add(1)
+	select {
+	case queue <- msg:
+	case <-a.close:
+		a.inflight.Done()
+		a.divert(msg)
+		a.release(msg)
+	}
+}
+
+// divertDispatched writes the messages left in the queues of the workers to the fallback.
+// It returns the number of written messages.
+func (a *Async) divertDispatched() (diverted int) {
+	for _, queue := range a.workQueues {
+	drain:
+		for {
+			select {
+			case msg := <-queue:
+				a.inflight.Done()
+				a.divert(msg)
+				a.release(msg)
+				diverted++
+			default:
+				break drain
+			}
+		}
+	}
+	return diverted
+}
+
+// work writes the messages of queue to the primary until the appender is shut down.
+func (a *Async) work(queue chan writeMessage) {
+	defer a.workersDone.Done()
+	var b batch
+	for {
+		select {
+		case <-a.close:
+			return
+		case msg := <-queue:
+			if a.batcher == nil {
+				a.forward(msg)
+				a.inflight.Done()
+				continue
+			}
+			b.add(msg)
+			a.collect(&b, queue)
+			n := len(b.msgs)
+			a.deliverBatch(&b, a.batcher)
+			a.inflight.Add(-n)
+		}
+	}
+}
+
+// collect adds the messages of queue to b until it holds batchSize messages.
+// If queue runs empty, it waits for more messages up to batchLinger.
+func (a *Async) collect(b *batch, queue chan writeMessage) {
+	lingering := false
+	defer func() {
+		if lingering {
+			b.stopLinger()
+		}
+	}()
+	for len(b.msgs) < a.batchSize {
+		select {
+		case msg := <-queue:
+			b.add(msg)
+			continue
+		default:
+		}
+		if a.batchLinger <= 0 {
+			return
+		}
+		if !lingering {
+			b.startLinger(a.batchLinger)
+			lingering = true
+		}
+		select {
+		case msg := <-queue:
+			b.add(msg)
+		case <-b.linger.C:
+			lingering = false
+			return
+		case <-a.close:
+			return
+		}
+	}
+}
+
+// partition maps key to one of n partitions using FNV-1a.
+func partition(key string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
@@ -0,0 +1,299 @@
+package appender
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// PressureSignal is implemented by appenders that can tell how close they are to dropping entries.
+type PressureSignal interface {
+	// Pressure returns a value from 0, idle, to 1, full.
+	Pressure() float64
+}
+
+var _ PressureSignal = &Async{}
+
+// Pressure returns the fill of the queue, by count or by bytes if limited, whichever is higher.
+func (a *Async) Pressure() float64 {
+	pressure := 0.0
+	if maxQueueLength := a.limits().maxQueueLength; maxQueueLength > 0 {
+		pressure = float64(a.queueDepth()) / float64(maxQueueLength)
+	}
+	if a.maxQueueBytes > 0 {
+		bytes := float64(atomic.LoadInt64(&a.stats.queueBytes)) / float64(a.maxQueueBytes)
+		if bytes > pressure {
+			pressure = bytes
+		}
+	}
+	if pressure > 1 {
+		// a shrunk queue might hold more messages than its length
+		return 1
+	}
+	return pressure
+}
+
+// BackpressureController raises a zap.AtomicLevel step by step while a PressureSignal stays high,
+// so the loggers drop low level entries before encoding them,
+// and lowers it step by step back to where it started once the pressure cleared.
+//
+// The level is raised after the pressure was at or above the raise threshold for a number of
+// consecutive samples and lowered after it was below the lower threshold for a number of
+// consecutive samples. The gap between the thresholds keeps the level from flapping.
+type BackpressureController struct {
+	level  zap.AtomicLevel
+	signal PressureSignal
+
+	interval      time.Duration
+	raiseAt       float64
+	lowerAt       float64
+	raiseAfter    int
+	lowerAfter    int
+	maxLevel      zapcore.Level
+	transitionLog Appender
+	transitionEnc zapcore.Encoder
+
+	mu       sync.Mutex
+	base     zapcore.Level // the level before the first raise
+	raised   int           // the number of steps the level is raised by
+	high     int           // consecutive samples at or above raiseAt
+	low      int           // consecutive samples below lowerAt
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// BackpressureOption configures a BackpressureController.
+type BackpressureOption interface {
+	apply(*BackpressureController) error
+}
+
+type backpressureOptionsFunc func(*BackpressureController) error
+
+func (f backpressureOptionsFunc) apply(c *BackpressureController) error {
+	return f(c)
+}
+
+// NewBackpressureController creates a controller adjusting level to the pressure of signal.
+// Unless configured otherwise, it samples signal every 100ms, raises the level after 5 samples
+// at or above 0.8, lowers it after 20 samples below 0.5 and raises it to the error level at most.
+// The controller runs until Stop is called.
+func NewBackpressureController(level zap.AtomicLevel, signal PressureSignal, options ...BackpressureOption) (*BackpressureController, error) {
+	if signal == nil {
+		return nil, errors.New("signal must not be nil")
+	}
+	c := &BackpressureController{
+		level:      level,
+		signal:     signal,
+		interval:   100 * time.Millisecond,
+		raiseAt:    0.8,
+		lowerAt:    0.5,
+		raiseAfter: 5,
+		lowerAfter: 20,
+		maxLevel:   zapcore.ErrorLevel,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, option := range options {
+		if err := option.apply(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.interval == 0 {
+		close(c.done)
+		return c, nil
+	}
+	go c.run()
+	return c, nil
+}
+
+// BackpressureInterval sets how often the pressure is sampled.
+// With 0 no routine is started and Observe must be called by the owner of the controller.
+func BackpressureInterval(interval time.Duration) BackpressureOption {
+	return backpressureOptionsFunc(func(c *BackpressureController) error {
+		if interval < 0 {
+			return errors.New("interval must not be negative")
+		}
+		c.interval = interval
+		return nil
+	})
+}
+
+// BackpressureThresholds sets the pressure at which the level is raised
+// and the lower pressure below which it is lowered again.
+func BackpressureThresholds(raiseAt, lowerAt float64) BackpressureOption {
+	return backpressureOptionsFunc(func(c *BackpressureController) error {
+		if raiseAt <= 0 || raiseAt > 1 {
+			return errors.New("raiseAt must be greater than 0 and at most 1")
+		}
+		if lowerAt < 0 || lowerAt >= raiseAt {
+			return errors.New("lowerAt must not be negative and less than raiseAt")
+		}
+		c.raiseAt = raiseAt
+		c.lowerAt = lowerAt
+		return nil
+	})
+}
+
+// BackpressureSamples sets how many consecutive samples must cross a threshold
+// before the level is raised, respectively lowered, by a step.
+func BackpressureSamples(raiseAfter, lowerAfter int) BackpressureOption {
+	return backpressureOptionsFunc(func(c *BackpressureController) error {
+		if raiseAfter <= 0 || lowerAfter <= 0 {
+			return errors.New("samples must be positive")
+		}
+		c.raiseAfter = raiseAfter
+		c.lowerAfter = lowerAfter
+		return nil
+	})
+}
+
+// BackpressureMaxLevel sets the level the controller raises the level to at most.
+func BackpressureMaxLevel(maxLevel zapcore.Level) BackpressureOption {
+	return backpressureOptionsFunc(func(c *BackpressureController) error {
+		if maxLevel > zapcore.FatalLevel {
+			return errors.New("maxLevel must be at most the fatal level")
+		}
+		c.maxLevel = maxLevel
+		return nil
+	})
+}
+
+// BackpressureLogTransitionsTo writes an entry encoded by enc to fallback whenever the level changes.
+// The entries are written regardless of the level, as the level is what they report.
+func BackpressureLogTransitionsTo(fallback Appender, enc zapcore.Encoder) BackpressureOption {
+	return backpressureOptionsFunc(func(c *BackpressureController) error {
+		if fallback == nil {
+			return errors.New("fallback must not be nil")
+		}
+		if enc == nil {
+			return errors.New("enc must not be nil")
+		}
+		c.transitionLog = NewSynchronizing(fallback)
+		c.transitionEnc = enc
+		return nil
+	})
+}
+
+func (c *BackpressureController) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Observe()
+		}
+	}
+}
+
+// Observe samples the pressure once and adjusts the level.
+// The controller calls it every interval.
+func (c *BackpressureController) Observe() {
+	pressure := c.signal.Pressure()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case pressure >= c.raiseAt:
+		c.high++
+		c.low = 0
+		if c.high >= c.raiseAfter {
+			c.high = 0
+			c.raise(pressure)
+		}
+	case pressure < c.lowerAt:
+		c.low++
+		c.high = 0
+		if c.low >= c.lowerAfter {
+			c.low = 0
+			c.lower(pressure)
+		}
+	default:
+		// between the thresholds the level is kept
+		c.high = 0
+		c.low = 0
+	}
+}
+
+// Raised returns the number of steps the level is currently raised by.
+func (c *BackpressureController) Raised() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.raised
+}
+
+// Stop stops sampling and restores the level from before the first raise.
+func (c *BackpressureController) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.raised > 0 {
+			c.raised = 0
+			c.transition(c.base, c.signal.Pressure())
+		}
+	})
+}
+
+func (c *BackpressureController) raise(pressure float64) {
+	current := c.level.Level()
+	if current >= c.maxLevel {
+		return
+	}
+	if c.raised == 0 {
+		c.base = current
+	}
+	c.raised++
+	c.transition(current+1, pressure)
+}
+
+func (c *BackpressureController) lower(pressure float64) {
+	if c.raised == 0 {
+		return
+	}
+	c.raised--
+	next := c.level.Level() - 1
+	if c.raised == 0 || next < c.base {
+		// the level might have been changed by others meanwhile
+		c.raised = 0
+		next = c.base
+	}
+	c.transition(next, pressure)
+}
+
+// transition sets the level and logs the change.
+func (c *BackpressureController) transition(level zapcore.Level, pressure float64) {
+	previous := c.level.Level()
+	c.level.SetLevel(level)
+	if c.transitionLog == nil || previous == level {
+		return
+	}
+	ent := zapcore.Entry{
+		Level:      zapcore.WarnLevel,
+		Time:       time.Now(),
+		LoggerName: "backpressure",
+		Message:    "log level raised due to backpressure",
+	}
+	if level < previous {
+		ent.Level = zapcore.InfoLevel
+		ent.Message = "log level lowered as backpressure cleared"
+	}
+	buf, err := c.transitionEnc.Clone().EncodeEntry(ent, []zapcore.Field{
+		zap.Stringer("from", previous),
+		zap.Stringer("to", level),
+		zap.Float64("pressure", pressure),
+	})
+	if err != nil {
+		return
+	}
+	_, _ = c.transitionLog.Write(buf.Bytes(), ent)
+	buf.Free()
+}
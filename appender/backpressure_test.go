@@ -0,0 +1,122 @@
+package appender_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/delixfe/zap_ing/appender"
+	"github.com/delixfe/zap_ing/appender/chaos"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type pressure float64
+
+func (p *pressure) Pressure() float64 {
+	return float64(*p)
+}
+
+func TestBackpressureController(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	var mu sync.Mutex
+	var logged []string
+	transitions := appender.NewDelegating(func(p []byte, ent zapcore.Entry) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, string(p))
+		return len(p), nil
+	}, nil, false)
+	signal := pressure(0)
+	controller, err := appender.NewBackpressureController(level, &signal,
+		appender.BackpressureInterval(0),
+		appender.BackpressureThresholds(0.8, 0.5),
+		appender.BackpressureSamples(2, 3),
+		appender.BackpressureMaxLevel(zapcore.WarnLevel),
+		appender.BackpressureLogTransitionsTo(transitions, zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observe := func(p float64, times int, expected zapcore.Level) {
+		t.Helper()
+		signal = pressure(p)
+		for i := 0; i < times; i++ {
+			controller.Observe()
+		}
+		if got := level.Level(); got != expected {
+			t.Fatalf("after %d samples of %.1f: expected level %s, got %s", times, p, expected, got)
+		}
+	}
+	observe(0.9, 1, zapcore.DebugLevel)
+	observe(0.9, 1, zapcore.InfoLevel)
+	observe(0.9, 2, zapcore.WarnLevel)
+	observe(0.9, 4, zapcore.WarnLevel) // max level
+	// hysteresis: between the thresholds the level is kept
+	observe(0.6, 10, zapcore.WarnLevel)
+	observe(0.4, 2, zapcore.WarnLevel)
+	observe(0.6, 1, zapcore.WarnLevel)
+	observe(0.4, 3, zapcore.InfoLevel)
+	observe(0.4, 3, zapcore.DebugLevel)
+	observe(0.0, 6, zapcore.DebugLevel) // never below the initial level
+
+	if controller.Raised() != 0 {
+		t.Errorf("expected the level not to be raised, got %d", controller.Raised())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logged) != 4 {
+		t.Fatalf("expected 4 transitions to be logged, got %d: %v", len(logged), logged)
+	}
+	if !strings.Contains(logged[0], `"from":"debug","to":"info"`) {
+		t.Errorf("expected the first raise to be logged, got %s", logged[0])
+	}
+	if !strings.Contains(logged[3], `"level":"info"`) || !strings.Contains(logged[3], `"from":"info","to":"debug"`) {
+		t.Errorf("expected the last lowering to be logged, got %s", logged[3])
+	}
+}
+
+func TestBackpressureController_Stop(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	signal := pressure(1)
+	controller, _ := appender.NewBackpressureController(level, &signal,
+		appender.BackpressureInterval(0),
+		appender.BackpressureSamples(1, 1),
+	)
+	controller.Observe()
+	controller.Observe()
+	if got := level.Level(); got != zapcore.ErrorLevel {
+		t.Fatalf("expected the error level, got %s", got)
+	}
+	controller.Stop()
+	if got := level.Level(); got != zapcore.InfoLevel {
+		t.Errorf("expected Stop to restore the info level, got %s", got)
+	}
+}
+
+func TestAsync_Pressure(t *testing.T) {
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	async, _ := appender.NewAsync(blocking,
+		appender.AsyncMaxQueueLength(10),
+		appender.AsyncOnQueueNearlyFullDropNewest(),
+	)
+	defer async.Shutdown(context.Background())
+
+	Write(async) // blocks the forwarder
+	time.Sleep(time.Millisecond * 10)
+	for i := 0; i < 5; i++ {
+		Write(async)
+	}
+	if got := async.Pressure(); got != 0.5 {
+		t.Errorf("expected a pressure of 0.5, got %f", got)
+	}
+	blocking.Fix()
+	async.Drain(context.Background())
+	if got := async.Pressure(); got != 0 {
+		t.Errorf("expected no pressure after drain, got %f", got)
+	}
+}
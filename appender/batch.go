@@ -0,0 +1,48 @@
+package appender
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// BatchAppender is an Appender that writes many messages in one call.
+// Async forwards batches to a primary implementing it if configured with AsyncBatchSize.
+type BatchAppender interface {
+	Appender
+
+	// WriteBatch writes ps[i] for ents[i]; ps and ents have the same length.
+	// It returns the number of messages written completely,
+	// which are the first n messages of the batch.
+	// must not retain ps
+	WriteBatch(ps [][]byte, ents []zapcore.Entry) (n int, err error)
+}
+
+// BatchWriter is implemented by outputs of Writer that write many buffers in one call,
+// e.g. using a single writev syscall.
+type BatchWriter interface {
+	// WriteBatch writes ps in order.
+	// It returns the number of buffers written completely.
+	WriteBatch(ps [][]byte) (n int, err error)
+}
+
+// writeBatch writes the batch to a with a single call if a is a BatchAppender
+// and message by message otherwise.
+func writeBatch(a Appender, ps [][]byte, ents []zapcore.Entry) (n int, err error) {
+	if b, ok := a.(BatchAppender); ok {
+		return b.WriteBatch(ps, ents)
+	}
+	for n = range ps {
+		if _, err = a.Write(ps[n], ents[n]); err != nil {
+			return n, err
+		}
+	}
+	return len(ps), nil
+}
+
+// completed returns the number of ps written completely by writing written bytes.
+func completed(ps [][]byte, written int) (n int) {
+	for n < len(ps) && written >= len(ps[n]) {
+		written -= len(ps[n])
+		n++
+	}
+	return n
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/delixfe/zap_ing/appender"
+	"github.com/delixfe/zap_ing/appender/chaos"
 	"go.uber.org/zap"
 	"go.uber.org/zap/buffer"
 	"go.uber.org/zap/zapcore"
@@ -64,13 +65,21 @@ func BenchmarkFallbackEnveloping(b *testing.B) {
 			b.Run("async", func(b *testing.B) {
 				a, _ := appender.NewAsync(writer,
 					appender.AsyncMaxQueueLength(1000),
-					appender.AsyncQueueMonitorPeriod(time.Hour),
 				)
 				b.Cleanup(func() {
 					a.Shutdown(context.TODO())
 				})
 				RunWithAppender(a, b, config)
 			})
+			b.Run("async parallel", func(b *testing.B) {
+				a, _ := appender.NewAsync(writer,
+					appender.AsyncMaxQueueLength(1000),
+				)
+				b.Cleanup(func() {
+					a.Shutdown(context.TODO())
+				})
+				RunParallelWithAppender(a, b, config)
+			})
 			b.Run("chained_no_async", func(b *testing.B) {
 				var a appender.Appender = writer
 				a = appender.NewEnvelopingPreSuffix(a, "prefix: ", "")
@@ -96,3 +105,48 @@ func RunWithCore(core zapcore.Core, b *testing.B, config benchConfig) {
 		logger.Info(message)
 	}
 }
+
+func RunParallelWithAppender(a appender.Appender, b *testing.B, config benchConfig) {
+	core := appender.NewAppenderCore(zapcore.NewJSONEncoder(encoderConfig), a, zapcore.DebugLevel)
+	message := config.message
+	logger := zap.New(core)
+	logger.Info("Warmup")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			logger.Info(message)
+		}
+	})
+}
+
+// BenchmarkAsyncWrite_blockedPrimary measures how long Write blocks
+// while the queue overflows because the primary does not return.
+func BenchmarkAsyncWrite_blockedPrimary(b *testing.B) {
+	blocking := chaos.NewBlockingSwitchable(appender.NewDiscard())
+	blocking.Break()
+	a, _ := appender.NewAsync(blocking,
+		appender.AsyncMaxQueueLength(100),
+		appender.AsyncOnQueueNearlyFullDropOldest(),
+	)
+	b.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		a.Shutdown(ctx)
+		blocking.Fix()
+	})
+	p := []byte("message")
+	ent := zapcore.Entry{Message: "message"}
+
+	var max time.Duration
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		_, _ = a.Write(p, ent)
+		if d := time.Since(start); d > max {
+			max = d
+		}
+	}
+	b.ReportMetric(float64(max.Nanoseconds()), "max-ns")
+}
@@ -2,6 +2,7 @@ package chaos
 
 import (
 	"context"
+	"sync"
 
 	"github.com/delixfe/zap_ing/appender"
 	"go.uber.org/zap/zapcore"
@@ -14,9 +15,11 @@ var (
 
 type BlockingSwitchable struct {
 	primary appender.Appender
-	enabled bool
-	waiting chan struct{}
 	ctx     context.Context
+
+	mu      sync.Mutex
+	enabled bool
+	waiting chan struct{} // closed by Fix
 }
 
 func NewBlockingSwitchable(inner appender.Appender) *BlockingSwitchable {
@@ -35,10 +38,14 @@ func NewBlockingSwitchableCtx(ctx context.Context, inner appender.Appender) *Blo
 }
 
 func (a *BlockingSwitchable) Breaking() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	return a.enabled
 }
 
 func (a *BlockingSwitchable) Break() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	if a.enabled {
 		return
 	}
@@ -47,16 +54,24 @@ func (a *BlockingSwitchable) Break() {
 }
 
 func (a *BlockingSwitchable) Fix() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.enabled {
+		return
+	}
 	a.enabled = false
 	close(a.waiting)
 }
 
 func (a *BlockingSwitchable) Write(p []byte, ent zapcore.Entry) (n int, err error) {
-	if a.enabled {
+	a.mu.Lock()
+	enabled, waiting := a.enabled, a.waiting
+	a.mu.Unlock()
+	if enabled {
 		select {
 		case <-a.ctx.Done():
 			return 0, a.ctx.Err()
-		case <-a.waiting:
+		case <-waiting:
 		}
 	}
 	n, err = a.primary.Write(p, ent)
@@ -14,7 +14,9 @@ func TestBlockingSwitchable_Break(t *testing.T) {
 	written := uint32(0)
 	ctx := context.Background()
 	if deadline, ok := t.Deadline(); ok {
-		ctx, _ = context.WithDeadline(context.Background(), deadline)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		defer cancel()
 	}
 
 	inner := appender.NewDelegating(func(p []byte, ent zapcore.Entry) (n int, err error) {
@@ -24,7 +26,7 @@ func TestBlockingSwitchable_Break(t *testing.T) {
 
 	blocking := NewBlockingSwitchableCtx(ctx, inner)
 	blocking.Write([]byte{}, zapcore.Entry{})
-	if written != 1 {
+	if atomic.LoadUint32(&written) != 1 {
 		t.Fatal("expected 1 write")
 	}
 
@@ -44,6 +46,6 @@ func TestBlockingSwitchable_Break(t *testing.T) {
 	time.Sleep(time.Millisecond * 100)
 
 	if atomic.LoadUint32(&written) != 2 {
-		t.Errorf("expected 2nd write after unblocking, written is %d", written)
+		t.Errorf("expected 2nd write after unblocking, written is %d", atomic.LoadUint32(&written))
 	}
 }
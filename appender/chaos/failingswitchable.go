@@ -2,6 +2,8 @@ package chaos
 
 import (
 	"errors"
+	"sync/atomic"
+
 	"github.com/delixfe/zap_ing/appender"
 	"go.uber.org/zap/zapcore"
 )
@@ -15,30 +17,29 @@ var (
 
 type FailingSwitchable struct {
 	primary appender.Appender
-	enabled bool
+	enabled int32
 }
 
 func NewFailingSwitchable(inner appender.Appender) *FailingSwitchable {
 	return &FailingSwitchable{
 		primary: inner,
-		enabled: false,
 	}
 }
 
 func (a *FailingSwitchable) Breaking() bool {
-	return a.enabled
+	return atomic.LoadInt32(&a.enabled) != 0
 }
 
 func (a *FailingSwitchable) Break() {
-	a.enabled = true
+	atomic.StoreInt32(&a.enabled, 1)
 }
 
 func (a *FailingSwitchable) Fix() {
-	a.enabled = false
+	atomic.StoreInt32(&a.enabled, 0)
 }
 
 func (a *FailingSwitchable) Write(p []byte, ent zapcore.Entry) (n int, err error) {
-	if a.enabled {
+	if a.Breaking() {
 		return 0, ErrFailEnabled
 	}
 	n, err = a.primary.Write(p, ent)
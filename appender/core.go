@@ -47,6 +47,8 @@ func Synchronized(s interface{}) bool {
 }
 
 var _ SynchronizationAwareAppender = &Synchronizing{}
+var _ BatchAppender = &Synchronizing{}
+var _ SequencedAppender = &Synchronizing{}
 
 type Synchronizing struct {
 	primary Appender
@@ -72,6 +74,18 @@ func (s *Synchronizing) Write(p []byte, ent zapcore.Entry) (n int, err error) {
 	return s.primary.Write(p, ent)
 }
 
+func (s *Synchronizing) WriteSequenced(p []byte, ent zapcore.Entry, seq uint64) (n int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return writeSequenced(s.primary, p, ent, seq)
+}
+
+func (s *Synchronizing) WriteBatch(ps [][]byte, ents []zapcore.Entry) (n int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return writeBatch(s.primary, ps, ents)
+}
+
 func (s *Synchronizing) Sync() error {
 	//TODO: should we lock Sync?
 	return s.primary.Sync()
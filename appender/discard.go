@@ -5,6 +5,7 @@ import (
 )
 
 var _ SynchronizationAwareAppender = &Discard{}
+var _ BatchAppender = &Discard{}
 
 type Discard struct {
 }
@@ -17,6 +18,10 @@ func (a *Discard) Write(p []byte, _ zapcore.Entry) (int, error) {
 	return len(p), nil
 }
 
+func (a *Discard) WriteBatch(ps [][]byte, _ []zapcore.Entry) (int, error) {
+	return len(ps), nil
+}
+
 func (a *Discard) Sync() error {
 	return nil
 }
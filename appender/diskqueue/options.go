@@ -0,0 +1,36 @@
+package diskqueue
+
+import "errors"
+
+type Option interface {
+	apply(*Queue) error
+}
+
+type optionFunc func(*Queue) error
+
+func (f optionFunc) apply(q *Queue) error {
+	return f(q)
+}
+
+// MaxBytes limits the total size of the entries in the queue.
+func MaxBytes(maxBytes int64) Option {
+	return optionFunc(func(q *Queue) error {
+		if maxBytes <= 0 {
+			return errors.New("maxBytes must be positive")
+		}
+		q.maxBytes = maxBytes
+		return nil
+	})
+}
+
+// SegmentBytes sets the size after which a new segment file is started.
+// Segment files are deleted once all their entries are popped.
+func SegmentBytes(segmentBytes int64) Option {
+	return optionFunc(func(q *Queue) error {
+		if segmentBytes <= 0 {
+			return errors.New("segmentBytes must be positive")
+		}
+		q.segmentBytes = segmentBytes
+		return nil
+	})
+}
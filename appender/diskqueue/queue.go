@@ -0,0 +1,446 @@
+// Package diskqueue provides a FIFO queue of log entries persisted in segment files.
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	ErrFull   = errors.New("disk queue is full")
+	ErrClosed = errors.New("disk queue is closed")
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	cursorLen     = 16
+)
+
+type segment struct {
+	id      uint64
+	size    int64
+	records int // not popped yet
+}
+
+// Queue is a FIFO queue of log entries persisted in segment files within a directory.
+// The read position is persisted as well, so a reopened Queue continues with the
+// oldest entry that was not popped yet.
+// Queue is safe for concurrent use.
+type Queue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []segment // oldest first, the last one is written to
+	writer   *os.File
+	reader   *os.File
+	cursor   *os.File
+	readOff  int64
+	size     int64 // bytes of the records not popped yet
+	length   int
+	closed   bool
+	scratch  []byte
+	encoded  []byte
+	headSize int64 // size of the record returned by Peek, 0 if not peeked
+}
+
+// Open opens the queue persisted in dir, creating dir if necessary.
+func Open(dir string, options ...Option) (q *Queue, err error) {
+	q = &Queue{
+		dir: dir,
+	}
+
+	MaxBytes(64 << 20).apply(q)
+	SegmentBytes(4 << 20).apply(q)
+
+	for _, option := range options {
+		err = option.apply(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err = q.load(); err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	return q, nil
+}
+
+// load restores the state persisted in dir.
+func (q *Queue) load() (err error) {
+	ids, err := q.listSegments()
+	if err != nil {
+		return err
+	}
+
+	q.cursor, err = os.OpenFile(filepath.Join(q.dir, cursorFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	cursorSegment, cursorOff, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if id < cursorSegment {
+			// already consumed
+			if err = os.Remove(q.segmentPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		q.segments = append(q.segments, segment{id: id})
+	}
+	if len(q.segments) == 0 || q.segments[0].id != cursorSegment {
+		cursorOff = 0
+	}
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, segment{id: cursorSegment + 1})
+	}
+
+	for i := range q.segments {
+		start := int64(0)
+		if i == 0 {
+			start = cursorOff
+		}
+		if err = q.scan(&q.segments[i], start); err != nil {
+			return err
+		}
+	}
+	if q.segments[0].size < cursorOff {
+		cursorOff = q.segments[0].size
+	}
+	q.readOff = cursorOff
+
+	last := q.segments[len(q.segments)-1]
+	q.writer, err = os.OpenFile(q.segmentPath(last.id), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	q.reader, err = os.Open(q.segmentPath(q.segments[0].id))
+	if err != nil {
+		return err
+	}
+	return q.writeCursor()
+}
+
+func (q *Queue) listSegments() ([]uint64, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (q *Queue) readCursor() (id uint64, off int64, err error) {
+	var buf [cursorLen]byte
+	_, err = q.cursor.ReadAt(buf[:], 0)
+	if errors.Is(err, io.EOF) {
+		// new or torn cursor, start with the oldest segment
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[0:8]), int64(binary.LittleEndian.Uint64(buf[8:16])), nil
+}
+
+func (q *Queue) writeCursor() error {
+	var buf [cursorLen]byte
+	binary.LittleEndian.PutUint64(buf[0:8], q.segments[0].id)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(q.readOff))
+	_, err := q.cursor.WriteAt(buf[:], 0)
+	return err
+}
+
+// scan counts the valid records of seg starting at start.
+// A segment is truncated after its last valid record, which drops a record torn by a crash.
+func (q *Queue) scan(seg *segment, start int64) error {
+	f, err := os.OpenFile(q.segmentPath(seg.id), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	off := start
+	var header [headerLen]byte
+	for {
+		if _, err = f.ReadAt(header[:], off); err != nil {
+			break
+		}
+		bodyLen, sum := decodeHeader(header[:])
+		if err = q.checkBodyLen(bodyLen, off, info.Size()); err != nil {
+			break
+		}
+		q.scratch = grow(q.scratch, bodyLen)
+		if _, err = f.ReadAt(q.scratch, off+headerLen); err != nil {
+			break
+		}
+		if _, _, err = decodeBody(q.scratch, sum); err != nil {
+			break
+		}
+		off += headerLen + int64(bodyLen)
+		q.size += headerLen + int64(bodyLen)
+		q.length++
+		seg.records++
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, errCorrupt) {
+		return err
+	}
+	seg.size = off
+	return f.Truncate(off)
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// Push appends an entry. It returns ErrFull if the entry would exceed the maximum size.
+func (q *Queue) Push(p []byte, ent zapcore.Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+
+	q.encoded = encodeRecord(q.encoded, p, ent)
+	recordLen := int64(len(q.encoded))
+	if q.size+recordLen > q.maxBytes {
+		return ErrFull
+	}
+
+	last := &q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+recordLen > q.segmentBytes {
+		if err := q.roll(); err != nil {
+			return err
+		}
+		last = &q.segments[len(q.segments)-1]
+	}
+
+	if _, err := q.writer.WriteAt(q.encoded, last.size); err != nil {
+		return err
+	}
+	last.size += recordLen
+	last.records++
+	q.size += recordLen
+	q.length++
+	return nil
+}
+
+// roll starts a new segment.
+func (q *Queue) roll() error {
+	id := q.segments[len(q.segments)-1].id + 1
+	writer, err := os.OpenFile(q.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_ = q.writer.Close()
+	q.writer = writer
+	q.segments = append(q.segments, segment{id: id})
+	return nil
+}
+
+// Peek returns the oldest entry without removing it.
+// p is only valid until the next call to the Queue. ok is false if the queue is empty.
+// If the oldest entry is corrupt, Peek returns an error and Pop skips it,
+// along with the rest of its segment if its length is corrupt.
+func (q *Queue) Peek() (p []byte, ent zapcore.Entry, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ent, false, ErrClosed
+	}
+	if q.length == 0 {
+		return nil, ent, false, nil
+	}
+	if err = q.advance(); err != nil {
+		return nil, ent, false, err
+	}
+
+	var header [headerLen]byte
+	if _, err = q.reader.ReadAt(header[:], q.readOff); err != nil {
+		return nil, ent, false, err
+	}
+	bodyLen, sum := decodeHeader(header[:])
+	if err = q.checkBodyLen(bodyLen, q.readOff, q.segments[0].size); err != nil {
+		return nil, ent, false, err
+	}
+	q.scratch = grow(q.scratch, bodyLen)
+	if _, err = q.reader.ReadAt(q.scratch, q.readOff+headerLen); err != nil {
+		return nil, ent, false, err
+	}
+	p, ent, err = decodeBody(q.scratch, sum)
+	if err != nil {
+		return nil, ent, false, err
+	}
+	q.headSize = headerLen + int64(bodyLen)
+	return p, ent, true, nil
+}
+
+// Pop removes the oldest entry.
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if q.length == 0 {
+		return nil
+	}
+	records := 1
+	if q.headSize == 0 {
+		if err := q.advance(); err != nil {
+			return err
+		}
+		var header [headerLen]byte
+		if _, err := q.reader.ReadAt(header[:], q.readOff); err != nil {
+			return err
+		}
+		bodyLen, _ := decodeHeader(header[:])
+		q.headSize = headerLen + int64(bodyLen)
+		if q.checkBodyLen(bodyLen, q.readOff, q.segments[0].size) != nil {
+			// the following records cannot be found, so the rest of the segment is skipped
+			q.headSize = q.segments[0].size - q.readOff
+			records = q.segments[0].records
+		}
+	}
+
+	q.readOff += q.headSize
+	q.size -= q.headSize
+	q.length -= records
+	q.segments[0].records -= records
+	q.headSize = 0
+
+	if q.length == 0 && len(q.segments) == 1 {
+		// reclaim the space of the only segment
+		if err := q.writer.Truncate(0); err != nil {
+			return err
+		}
+		q.segments[0].size = 0
+		q.readOff = 0
+	}
+	return q.writeCursor()
+}
+
+// advance moves the reader to the next segment once the current one is consumed.
+func (q *Queue) advance() error {
+	for len(q.segments) > 1 && q.readOff >= q.segments[0].size {
+		next, err := os.Open(q.segmentPath(q.segments[1].id))
+		if err != nil {
+			return err
+		}
+		_ = q.reader.Close()
+		if err = os.Remove(q.segmentPath(q.segments[0].id)); err != nil {
+			_ = next.Close()
+			return err
+		}
+		q.reader = next
+		q.segments = q.segments[1:]
+		q.readOff = 0
+		q.headSize = 0
+		if err = q.writeCursor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.length
+}
+
+// Size returns the number of bytes the entries in the queue take on disk.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Sync commits the segment being written and the read position to stable storage.
+func (q *Queue) Sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if err := q.writer.Sync(); err != nil {
+		return err
+	}
+	return q.cursor.Sync()
+}
+
+// Close closes the files of the queue. The entries stay persisted.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	return q.closeFiles()
+}
+
+func (q *Queue) closeFiles() (err error) {
+	for _, f := range []*os.File{q.writer, q.reader, q.cursor} {
+		if f == nil {
+			continue
+		}
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// checkBodyLen returns errCorrupt if the body of the record at off does not fit
+// into the size of its segment or the max bytes, so a corrupt header does not cause a huge allocation.
+func (q *Queue) checkBodyLen(bodyLen int, off, size int64) error {
+	if int64(bodyLen) > size-off-headerLen || headerLen+int64(bodyLen) > q.maxBytes {
+		return errCorrupt
+	}
+	return nil
+}
+
+func grow(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
@@ -0,0 +1,194 @@
+package diskqueue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func push(t *testing.T, q *Queue, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		require.NoError(t, q.Push([]byte(fmt.Sprintf("payload %d", i)), zapcore.Entry{Message: fmt.Sprint(i)}))
+	}
+}
+
+func requirePop(t *testing.T, q *Queue, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		p, ent, ok, err := q.Peek()
+		require.NoError(t, err)
+		require.True(t, ok, "expected entry %d", i)
+		require.Equal(t, fmt.Sprintf("payload %d", i), string(p))
+		require.Equal(t, fmt.Sprint(i), ent.Message)
+		require.NoError(t, q.Pop())
+	}
+}
+
+func requireEmpty(t *testing.T, q *Queue) {
+	t.Helper()
+	_, _, ok, err := q.Peek()
+	require.NoError(t, err)
+	require.False(t, ok, "expected an empty queue")
+	require.Equal(t, 0, q.Len())
+	require.EqualValues(t, 0, q.Size())
+}
+
+func TestQueue_PushPeekPop_keepsOrder(t *testing.T) {
+	q, err := Open(t.TempDir(), SegmentBytes(100))
+	require.NoError(t, err)
+	defer q.Close()
+
+	requireEmpty(t, q)
+	push(t, q, 1, 20)
+	assert.Equal(t, 20, q.Len())
+	requirePop(t, q, 1, 10)
+	push(t, q, 21, 30)
+	requirePop(t, q, 11, 30)
+	requireEmpty(t, q)
+}
+
+func TestQueue_Peek_returnsEntryMetadata(t *testing.T) {
+	q, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer q.Close()
+
+	ent := zapcore.Entry{
+		Level:      zapcore.ErrorLevel,
+		Time:       time.Unix(1600000000, 42),
+		LoggerName: "logger",
+		Message:    "message",
+		Caller:     zapcore.EntryCaller{Defined: true, File: "file.go", Line: 7, Function: "fn"},
+		Stack:      "stack",
+	}
+	require.NoError(t, q.Push([]byte("payload"), ent))
+
+	p, got, ok, err := q.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "payload", string(p))
+	assert.True(t, ent.Time.Equal(got.Time), "time")
+	got.Time = ent.Time
+	assert.Equal(t, ent, got)
+}
+
+func TestQueue_Push_exceedingMaxBytes_returnsErrFull(t *testing.T) {
+	q, err := Open(t.TempDir(), MaxBytes(120))
+	require.NoError(t, err)
+	defer q.Close()
+
+	payload := make([]byte, 20)
+	require.NoError(t, q.Push(payload, zapcore.Entry{}))
+	require.NoError(t, q.Push(payload, zapcore.Entry{}))
+	assert.ErrorIs(t, q.Push(payload, zapcore.Entry{}), ErrFull)
+
+	require.NoError(t, q.Pop())
+	assert.NoError(t, q.Push(payload, zapcore.Entry{}), "space is available again after pop")
+}
+
+func TestQueue_Open_continuesAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, SegmentBytes(100))
+	require.NoError(t, err)
+	push(t, q, 1, 20)
+	requirePop(t, q, 1, 5)
+	require.NoError(t, q.Close())
+
+	q, err = Open(dir, SegmentBytes(100))
+	require.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 15, q.Len())
+	requirePop(t, q, 6, 20)
+	requireEmpty(t, q)
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.NoError(t, err)
+	assert.Len(t, segments, 1, "consumed segments are removed")
+}
+
+func TestQueue_Open_dropsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	require.NoError(t, err)
+	push(t, q, 1, 2)
+	require.NoError(t, q.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	info, err := os.Stat(segments[0])
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(segments[0], info.Size()-1))
+
+	q, err = Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 1, q.Len())
+	requirePop(t, q, 1, 1)
+	push(t, q, 3, 3)
+	requirePop(t, q, 3, 3)
+}
+
+// writeHugeLength writes a record header whose body length exceeds any segment to segment at off.
+func writeHugeLength(t *testing.T, segment string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(segment, os.O_RDWR, 0o644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteAt([]byte{0xf0, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1}, off)
+	require.NoError(t, err)
+}
+
+func TestQueue_Open_dropsTornRecordWithHugeLength(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	require.NoError(t, err)
+	push(t, q, 1, 2)
+	size := q.Size()
+	require.NoError(t, q.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	writeHugeLength(t, segments[0], size)
+
+	q, err = Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, size, q.Size())
+	requirePop(t, q, 1, 2)
+	push(t, q, 3, 3)
+	requirePop(t, q, 3, 3)
+	requireEmpty(t, q)
+}
+
+func TestQueue_Peek_corruptLength_reportsAndPopSkipsSegment(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+	push(t, q, 1, 1)
+	first := q.Size()
+	push(t, q, 2, 3)
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	writeHugeLength(t, segments[0], first)
+
+	requirePop(t, q, 1, 1)
+	_, _, _, err = q.Peek()
+	assert.ErrorIs(t, err, errCorrupt)
+	// the records following the corrupt one cannot be found
+	require.NoError(t, q.Pop())
+	requireEmpty(t, q)
+	push(t, q, 4, 4)
+	requirePop(t, q, 4, 4)
+}
@@ -0,0 +1,148 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// record layout:
+//
+//	uint32 length of body
+//	uint32 crc32 (IEEE) of body
+//	body:
+//	  int8   level
+//	  int64  time in unix nanoseconds, 0 for the zero time
+//	  uint8  caller defined
+//	  int64  caller line
+//	  uvarint prefixed logger name, message, caller file, caller function, stack and payload
+const headerLen = 8
+
+var errCorrupt = errors.New("corrupt record")
+
+func encodeRecord(dst []byte, p []byte, ent zapcore.Entry) []byte {
+	var header [headerLen]byte
+	dst = append(dst[:0], header[:]...)
+
+	dst = append(dst, byte(ent.Level))
+	var nanos int64
+	if !ent.Time.IsZero() {
+		nanos = ent.Time.UnixNano()
+	}
+	dst = appendInt64(dst, nanos)
+	if ent.Caller.Defined {
+		dst = append(dst, 1)
+	} else {
+		dst = append(dst, 0)
+	}
+	dst = appendInt64(dst, int64(ent.Caller.Line))
+	dst = appendString(dst, ent.LoggerName)
+	dst = appendString(dst, ent.Message)
+	dst = appendString(dst, ent.Caller.File)
+	dst = appendString(dst, ent.Caller.Function)
+	dst = appendString(dst, ent.Stack)
+	dst = appendUvarint(dst, uint64(len(p)))
+	dst = append(dst, p...)
+
+	body := dst[headerLen:]
+	binary.LittleEndian.PutUint32(dst[0:4], uint32(len(body)))
+	binary.LittleEndian.PutUint32(dst[4:8], crc32.ChecksumIEEE(body))
+	return dst
+}
+
+// decodeHeader returns the length of the body and its checksum.
+func decodeHeader(header []byte) (bodyLen int, sum uint32) {
+	return int(binary.LittleEndian.Uint32(header[0:4])), binary.LittleEndian.Uint32(header[4:8])
+}
+
+// decodeBody decodes body. The returned payload references body.
+func decodeBody(body []byte, sum uint32) (p []byte, ent zapcore.Entry, err error) {
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ent, errCorrupt
+	}
+	d := decoder{buf: body}
+	ent.Level = zapcore.Level(int8(d.byte()))
+	if nanos := d.int64(); nanos != 0 {
+		ent.Time = time.Unix(0, nanos)
+	}
+	ent.Caller.Defined = d.byte() == 1
+	ent.Caller.Line = int(d.int64())
+	ent.LoggerName = string(d.bytes())
+	ent.Message = string(d.bytes())
+	ent.Caller.File = string(d.bytes())
+	ent.Caller.Function = string(d.bytes())
+	ent.Stack = string(d.bytes())
+	p = d.bytes()
+	if d.err != nil {
+		return nil, zapcore.Entry{}, d.err
+	}
+	return p, ent, nil
+}
+
+func appendInt64(dst []byte, v int64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	return append(dst, b[:]...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(dst, b[:n]...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// decoder reads the fields of a record body, remembering the first error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errCorrupt
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (d *decoder) bytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	n, read := binary.Uvarint(d.buf)
+	if read <= 0 || n > uint64(len(d.buf)) {
+		d.err = errCorrupt
+		return nil
+	}
+	d.buf = d.buf[read:]
+	return d.next(int(n))
+}
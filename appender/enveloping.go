@@ -14,11 +14,18 @@ import (
 //    but passing by value does not
 type EnvelopingFn func(p []byte, ent zapcore.Entry, output *buffer.Buffer) error
 
+// SequencedEnvelopingFn is an EnvelopingFn that also receives the sequence number
+// Async stamps on the entries with AsyncSequenceNumbers.
+// seq is 0 for entries without a sequence number.
+type SequencedEnvelopingFn func(p []byte, ent zapcore.Entry, seq uint64, output *buffer.Buffer) error
+
 var _ SynchronizationAwareAppender = &Enveloping{}
+var _ BatchAppender = &Enveloping{}
+var _ SequencedAppender = &Enveloping{}
 
 type Enveloping struct {
 	primary Appender
-	envFn   EnvelopingFn
+	envFn   SequencedEnvelopingFn
 }
 
 func (a *Enveloping) Synchronized() bool {
@@ -26,6 +33,13 @@ func (a *Enveloping) Synchronized() bool {
 }
 
 func NewEnveloping(inner Appender, envFn EnvelopingFn) *Enveloping {
+	return NewSequencedEnveloping(inner, func(p []byte, ent zapcore.Entry, _ uint64, output *buffer.Buffer) error {
+		return envFn(p, ent, output)
+	})
+}
+
+// NewSequencedEnveloping envelopes the messages with envFn, passing on the sequence numbers.
+func NewSequencedEnveloping(inner Appender, envFn SequencedEnvelopingFn) *Enveloping {
 	return &Enveloping{
 		primary: inner,
 		envFn:   envFn,
@@ -43,16 +57,46 @@ func NewEnvelopingPreSuffix(inner Appender, prefix, suffix string) *Enveloping {
 }
 
 func (a *Enveloping) Write(p []byte, ent zapcore.Entry) (n int, err error) {
+	return a.WriteSequenced(p, ent, 0)
+}
+
+func (a *Enveloping) WriteSequenced(p []byte, ent zapcore.Entry, seq uint64) (n int, err error) {
 	buf := bufferpool.Get()
 	defer buf.Free()
-	err = a.envFn(p, ent, buf)
+	err = a.envFn(p, ent, seq, buf)
 	if err != nil {
 		return
 	}
-	n, err = a.primary.Write(buf.Bytes(), ent)
+	n, err = writeSequenced(a.primary, buf.Bytes(), ent, seq)
 	return
 }
 
+// WriteBatch envelopes all messages and writes them to primary in one batch.
+// If enveloping a message fails, the messages before it are written.
+func (a *Enveloping) WriteBatch(ps [][]byte, ents []zapcore.Entry) (n int, err error) {
+	bufs := make([]*buffer.Buffer, 0, len(ps))
+	enveloped := make([][]byte, 0, len(ps))
+	defer func() {
+		for _, buf := range bufs {
+			buf.Free()
+		}
+	}()
+	var envErr error
+	for i, p := range ps {
+		buf := bufferpool.Get()
+		bufs = append(bufs, buf)
+		if envErr = a.envFn(p, ents[i], 0, buf); envErr != nil {
+			break
+		}
+		enveloped = append(enveloped, buf.Bytes())
+	}
+	n, err = writeBatch(a.primary, enveloped, ents[:len(enveloped)])
+	if err == nil {
+		err = envErr
+	}
+	return n, err
+}
+
 func (a *Enveloping) Sync() error {
 	return a.primary.Sync()
 }
@@ -2,12 +2,15 @@ package appender_test
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/delixfe/zap_ing/appender"
 	"github.com/delixfe/zap_ing/appender/chaos"
+	"github.com/delixfe/zap_ing/appender/diskqueue"
 	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -50,7 +53,8 @@ func Example_core() {
 }
 
 func ExampleAsync() {
-	ctx, _ := context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
 	writer := appender.NewWriter(zapcore.Lock(os.Stdout))
 
 	failing := chaos.NewFailingSwitchable(writer)
@@ -67,7 +71,6 @@ func ExampleAsync() {
 		appender.AsyncOnQueueNearlyFullForwardTo(appender.NewEnvelopingPreSuffix(writer, "QFALLBACK: ", "")),
 		appender.AsyncMaxQueueLength(10),
 		appender.AsyncQueueMinFreePercent(0.2),
-		appender.AsyncQueueMonitorPeriod(time.Millisecond),
 	)
 
 	core := appender.NewAppenderCore(zapcore.NewConsoleEncoder(encoderConfig), async, zapcore.DebugLevel)
@@ -80,6 +83,7 @@ func ExampleAsync() {
 	blocking.Break()
 
 	logger.Info("primary blocks while trying to send this", zap.Int("i", 1))
+	time.Sleep(time.Millisecond * 10)
 	for i := 2; i <= 15; i++ {
 		logger.Info("while broken", zap.Int("i", i))
 	}
@@ -106,3 +110,281 @@ func ExampleAsync() {
 	// PRIMARY:  info ** while broken ** {"i": 14}
 	// PRIMARY:  info ** while broken ** {"i": 15}
 }
+
+// sequencePrefix prefixes the messages with prefix and their sequence number.
+func sequencePrefix(prefix string) appender.SequencedEnvelopingFn {
+	return func(p []byte, _ zapcore.Entry, seq uint64, output *buffer.Buffer) error {
+		output.AppendString(prefix)
+		output.AppendUint(seq)
+		output.AppendString(": ")
+		_, err := output.Write(p)
+		return err
+	}
+}
+
+func ExampleAsyncSequenceNumbers() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	writer := appender.NewWriter(zapcore.Lock(os.Stdout))
+	blocking := chaos.NewBlockingSwitchableCtx(ctx, writer)
+
+	primaryOut := appender.NewSequencedEnveloping(blocking, sequencePrefix("PRIMARY "))
+	async, _ := appender.NewAsync(primaryOut,
+		appender.AsyncSequenceNumbers(),
+		appender.AsyncOnQueueNearlyFullForwardTo(appender.NewSequencedEnveloping(writer, sequencePrefix("QFALLBACK "))),
+		appender.AsyncMaxQueueLength(10),
+		appender.AsyncQueueMinFreePercent(0.2),
+	)
+
+	core := appender.NewAppenderCore(zapcore.NewConsoleEncoder(encoderConfig), async, zapcore.DebugLevel)
+	logger := zap.New(core)
+
+	logger.Info("this logs async")
+	time.Sleep(time.Millisecond * 10)
+
+	blocking.Break()
+	logger.Info("primary blocks while trying to send this", zap.Int("i", 1))
+	time.Sleep(time.Millisecond * 10)
+	for i := 2; i <= 11; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	blocking.Fix()
+	// the sequence numbers restore the order of the entries across the destinations,
+	// each destination receives them in order
+	async.Drain(ctx)
+
+	// Output:
+	// PRIMARY 1: info ** this logs async
+	// QFALLBACK 3: info ** while broken ** {"i": 2}
+	// QFALLBACK 4: info ** while broken ** {"i": 3}
+	// PRIMARY 2: info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY 5: info ** while broken ** {"i": 4}
+	// PRIMARY 6: info ** while broken ** {"i": 5}
+	// PRIMARY 7: info ** while broken ** {"i": 6}
+	// PRIMARY 8: info ** while broken ** {"i": 7}
+	// PRIMARY 9: info ** while broken ** {"i": 8}
+	// PRIMARY 10: info ** while broken ** {"i": 9}
+	// PRIMARY 11: info ** while broken ** {"i": 10}
+	// PRIMARY 12: info ** while broken ** {"i": 11}
+}
+
+// stalledAsyncLogger returns a logger writing through an Async with a queue of four
+// messages that keeps one slot free. The first message logged blocks the primary
+// until fix is called.
+func stalledAsyncLogger(ctx context.Context, option appender.AsyncOption) (logger *zap.Logger, async *appender.Async, fix func()) {
+	writer := appender.NewWriter(zapcore.Lock(os.Stdout))
+	blocking := chaos.NewBlockingSwitchableCtx(ctx, writer)
+	primaryOut := appender.NewEnvelopingPreSuffix(blocking, "PRIMARY:  ", "")
+
+	async, _ = appender.NewAsync(primaryOut,
+		option,
+		appender.AsyncMaxQueueLength(4),
+		appender.AsyncQueueMinFreeItems(1),
+	)
+
+	core := appender.NewAppenderCore(zapcore.NewConsoleEncoder(encoderConfig), async, zapcore.DebugLevel)
+	logger = zap.New(core)
+
+	blocking.Break()
+	logger.Info("primary blocks while trying to send this", zap.Int("i", 1))
+	time.Sleep(time.Millisecond * 10)
+
+	return logger, async, blocking.Fix
+}
+
+func ExampleAsyncOnQueueNearlyFullBlock() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	logger, async, fix := stalledAsyncLogger(ctx, appender.AsyncOnQueueNearlyFullBlock())
+	defer async.Shutdown(ctx)
+
+	for i := 2; i <= 5; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+
+	written := make(chan struct{})
+	go func() {
+		logger.Info("while broken", zap.Int("i", 6))
+		close(written)
+	}()
+	select {
+	case <-written:
+		fmt.Println("the 6th message was enqueued")
+	case <-time.After(time.Millisecond * 10):
+		fmt.Println("the 6th message blocks while the queue is full")
+	}
+
+	fix()
+	time.Sleep(time.Millisecond * 10)
+	<-written
+	async.Drain(ctx)
+
+	// Output:
+	// the 6th message blocks while the queue is full
+	// PRIMARY:  info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY:  info ** while broken ** {"i": 2}
+	// PRIMARY:  info ** while broken ** {"i": 3}
+	// PRIMARY:  info ** while broken ** {"i": 4}
+	// PRIMARY:  info ** while broken ** {"i": 5}
+	// PRIMARY:  info ** while broken ** {"i": 6}
+}
+
+func ExampleAsyncOnQueueNearlyFullDropNewest() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	logger, async, fix := stalledAsyncLogger(ctx, appender.AsyncOnQueueNearlyFullDropNewest())
+	defer async.Shutdown(ctx)
+
+	for i := 2; i <= 6; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+
+	fix()
+	time.Sleep(time.Millisecond * 10)
+	async.Drain(ctx)
+
+	// Output:
+	// PRIMARY:  info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY:  info ** while broken ** {"i": 2}
+	// PRIMARY:  info ** while broken ** {"i": 3}
+	// PRIMARY:  info ** while broken ** {"i": 4}
+}
+
+func ExampleAsyncOnQueueNearlyFullDropOldest() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	logger, async, fix := stalledAsyncLogger(ctx, appender.AsyncOnQueueNearlyFullDropOldest())
+	defer async.Shutdown(ctx)
+
+	for i := 2; i <= 6; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	fix()
+	time.Sleep(time.Millisecond * 10)
+	async.Drain(ctx)
+
+	// Output:
+	// PRIMARY:  info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY:  info ** while broken ** {"i": 4}
+	// PRIMARY:  info ** while broken ** {"i": 5}
+	// PRIMARY:  info ** while broken ** {"i": 6}
+}
+
+func ExampleAsyncOnQueueNearlyFullForwardTo() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	writer := appender.NewWriter(zapcore.Lock(os.Stdout))
+	fallback := appender.NewEnvelopingPreSuffix(writer, "QFALLBACK: ", "")
+	logger, async, fix := stalledAsyncLogger(ctx, appender.AsyncOnQueueNearlyFullForwardTo(fallback))
+	defer async.Shutdown(ctx)
+
+	for i := 2; i <= 6; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	fix()
+	time.Sleep(time.Millisecond * 10)
+	async.Drain(ctx)
+
+	// Output:
+	// QFALLBACK: info ** while broken ** {"i": 2}
+	// QFALLBACK: info ** while broken ** {"i": 3}
+	// PRIMARY:  info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY:  info ** while broken ** {"i": 4}
+	// PRIMARY:  info ** while broken ** {"i": 5}
+	// PRIMARY:  info ** while broken ** {"i": 6}
+}
+
+func ExampleAsyncOnQueueNearlyFullSpillTo() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	dir, _ := os.MkdirTemp("", "spill")
+	defer os.RemoveAll(dir)
+	spill, _ := diskqueue.Open(dir, diskqueue.MaxBytes(1<<20))
+	defer spill.Close()
+	logger, async, fix := stalledAsyncLogger(ctx, appender.AsyncOnQueueNearlyFullSpillTo(spill))
+	defer async.Shutdown(ctx)
+
+	for i := 2; i <= 6; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+	time.Sleep(time.Millisecond * 10)
+	fmt.Println("spilled to disk:", spill.Len())
+
+	fix()
+	time.Sleep(time.Millisecond * 10)
+	async.Drain(ctx)
+
+	// Output:
+	// spilled to disk: 2
+	// PRIMARY:  info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY:  info ** while broken ** {"i": 2}
+	// PRIMARY:  info ** while broken ** {"i": 3}
+	// PRIMARY:  info ** while broken ** {"i": 4}
+	// PRIMARY:  info ** while broken ** {"i": 5}
+	// PRIMARY:  info ** while broken ** {"i": 6}
+}
+
+func ExampleAsyncOnQueueNearlyFullDropBelow() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	logger, async, fix := stalledAsyncLogger(ctx, appender.AsyncOnQueueNearlyFullDropBelow(zapcore.WarnLevel))
+	defer async.Shutdown(ctx)
+
+	for i := 2; i <= 5; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+	logger.Warn("while broken", zap.Int("i", 6))
+
+	fix()
+	time.Sleep(time.Millisecond * 10)
+	async.Drain(ctx)
+
+	// Output:
+	// PRIMARY:  info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY:  info ** while broken ** {"i": 2}
+	// PRIMARY:  info ** while broken ** {"i": 3}
+	// PRIMARY:  info ** while broken ** {"i": 4}
+	// PRIMARY:  warn ** while broken ** {"i": 6}
+}
+
+// printEvicted is an OverflowStrategy printing and dropping the oldest queued entries.
+type printEvicted struct{}
+
+func (printEvicted) Admit(zapcore.Entry) bool { return true }
+
+func (printEvicted) Evicts() bool { return true }
+
+func (printEvicted) Evict(p []byte, _ zapcore.Entry) appender.DeliveryOutcome {
+	fmt.Printf("EVICTED:  %s", p)
+	return appender.DeliveryDropped
+}
+
+func ExampleAsyncOnQueueNearlyFull() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	logger, async, fix := stalledAsyncLogger(ctx, appender.AsyncOnQueueNearlyFull(printEvicted{}))
+	defer async.Shutdown(ctx)
+
+	for i := 2; i <= 6; i++ {
+		logger.Info("while broken", zap.Int("i", i))
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	fix()
+	time.Sleep(time.Millisecond * 10)
+	async.Drain(ctx)
+
+	// Output:
+	// EVICTED:  info ** while broken ** {"i": 2}
+	// EVICTED:  info ** while broken ** {"i": 3}
+	// PRIMARY:  info ** primary blocks while trying to send this ** {"i": 1}
+	// PRIMARY:  info ** while broken ** {"i": 4}
+	// PRIMARY:  info ** while broken ** {"i": 5}
+	// PRIMARY:  info ** while broken ** {"i": 6}
+}
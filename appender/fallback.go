@@ -6,6 +6,8 @@ import (
 )
 
 var _ SynchronizationAwareAppender = &Fallback{}
+var _ BatchAppender = &Fallback{}
+var _ SequencedAppender = &Fallback{}
 
 type Fallback struct {
 	primary   Appender
@@ -37,6 +39,37 @@ func (a *Fallback) Write(p []byte, ent zapcore.Entry) (n int, err error) {
 
 }
 
+// WriteSequenced passes seq on to primary and secondary.
+func (a *Fallback) WriteSequenced(p []byte, ent zapcore.Entry, seq uint64) (n int, err error) {
+	n, primErr := writeSequenced(a.primary, p, ent, seq)
+	if primErr == nil {
+		return n, nil
+	}
+	n, fallErr := writeSequenced(a.secondary, p, ent, seq)
+	if fallErr == nil {
+		return n, nil
+	}
+
+	// TODO: decide which error to return
+	return n, multierr.Append(primErr, fallErr)
+
+}
+
+// WriteBatch writes the batch to primary and the messages primary failed to write to secondary.
+func (a *Fallback) WriteBatch(ps [][]byte, ents []zapcore.Entry) (n int, err error) {
+	n, primErr := writeBatch(a.primary, ps, ents)
+	if primErr == nil {
+		return n, nil
+	}
+	written, fallErr := writeBatch(a.secondary, ps[n:], ents[n:])
+	n += written
+	if fallErr == nil {
+		return n, nil
+	}
+
+	return n, multierr.Append(primErr, fallErr)
+}
+
 func (a *Fallback) Sync() error {
 	return multierr.Append(a.primary.Sync(), a.secondary.Sync())
 }
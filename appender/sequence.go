@@ -0,0 +1,22 @@
+package appender
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// SequencedAppender is an Appender that receives the sequence numbers
+// Async stamps on the entries with AsyncSequenceNumbers.
+type SequencedAppender interface {
+	Appender
+
+	// WriteSequenced writes p for ent, which has the sequence number seq.
+	WriteSequenced(p []byte, ent zapcore.Entry, seq uint64) (n int, err error)
+}
+
+// writeSequenced writes p with seq if a is a SequencedAppender and without it otherwise.
+func writeSequenced(a Appender, p []byte, ent zapcore.Entry, seq uint64) (n int, err error) {
+	if s, ok := a.(SequencedAppender); ok {
+		return s.WriteSequenced(p, ent, seq)
+	}
+	return a.Write(p, ent)
+}
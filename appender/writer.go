@@ -1,11 +1,13 @@
 package appender
 
 import (
+	"github.com/delixfe/zap_ing/appender/internal/bufferpool"
 	"go.uber.org/zap/zapcore"
 	"syscall"
 )
 
 var _ Appender = &Writer{}
+var _ BatchAppender = &Writer{}
 
 type Writer struct {
 	out zapcore.WriteSyncer
@@ -19,6 +21,22 @@ func (a *Writer) Write(p []byte, ent zapcore.Entry) (n int, err error) {
 	return a.out.Write(p)
 }
 
+// WriteBatch writes the batch with a single call to out.
+// If out is a BatchWriter the buffers are handed over as they are,
+// otherwise they are concatenated first.
+func (a *Writer) WriteBatch(ps [][]byte, _ []zapcore.Entry) (n int, err error) {
+	if b, ok := a.out.(BatchWriter); ok {
+		return b.WriteBatch(ps)
+	}
+	buf := bufferpool.Get()
+	defer buf.Free()
+	for _, p := range ps {
+		_, _ = buf.Write(p)
+	}
+	written, err := a.out.Write(buf.Bytes())
+	return completed(ps, written), err
+}
+
 func (a *Writer) Sync() error {
 	// ignore non-actionable errors
 	// as per https://github.com/open-telemetry/opentelemetry-collector/issues/4153
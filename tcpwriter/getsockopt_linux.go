@@ -0,0 +1,15 @@
+//go:build linux && !386
+// +build linux,!386
+
+package tcpwriter
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getsockopt(fd uintptr, level, opt int, value unsafe.Pointer, size *uint32) syscall.Errno {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt),
+		uintptr(value), uintptr(unsafe.Pointer(size)), 0)
+	return errno
+}
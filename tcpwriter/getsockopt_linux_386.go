@@ -0,0 +1,18 @@
+//go:build linux && 386
+// +build linux,386
+
+package tcpwriter
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// sysGetsockopt is the socketcall of getsockopt, linux/386 has no getsockopt syscall.
+const sysGetsockopt = 15
+
+func getsockopt(fd uintptr, level, opt int, value unsafe.Pointer, size *uint32) syscall.Errno {
+	args := [5]uintptr{fd, uintptr(level), uintptr(opt), uintptr(value), uintptr(unsafe.Pointer(size))}
+	_, _, errno := syscall.Syscall(syscall.SYS_SOCKETCALL, sysGetsockopt, uintptr(unsafe.Pointer(&args)), 0)
+	return errno
+}
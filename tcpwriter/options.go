@@ -0,0 +1,213 @@
+package tcpwriter
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+type Option interface {
+	apply(*TcpWriter) error
+}
+
+type optionFunc func(*TcpWriter) error
+
+func (f optionFunc) apply(w *TcpWriter) error {
+	return f(w)
+}
+
+// WriteDeadline sets the deadline of a single write to the connection.
+// After it passed, the connection is closed and the write is retried on a new one.
+func WriteDeadline(deadline time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if deadline <= 0 {
+			return errors.New("deadline must be positive")
+		}
+		w.writeDeadLine = deadline
+		return nil
+	})
+}
+
+// WriteTimeout sets how long a write is retried before ErrWriteTimeout is returned.
+func WriteTimeout(timeout time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		w.WriteTimeout = timeout
+		return nil
+	})
+}
+
+// Backoff sets the function returning the time to wait before a write is retried.
+func Backoff(backoffFn BackoffFn) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if backoffFn == nil {
+			return errors.New("backoffFn must not be nil")
+		}
+		w.BackoffFn = backoffFn
+		return nil
+	})
+}
+
+// MonitorReadDeadline sets the deadline of the reads the monitor uses to detect a closed connection.
+func MonitorReadDeadline(deadline time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if deadline <= 0 {
+			return errors.New("deadline must be positive")
+		}
+		w.monitorReadDeadline = deadline
+		return nil
+	})
+}
+
+// DialTimeout limits the time to connect.
+// It only applies to the connections dialed by a writer created with NewDialingTcpWriter.
+func DialTimeout(timeout time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		w.dialer.Timeout = timeout
+		return nil
+	})
+}
+
+// LocalAddr sets the local source address to connect from.
+// It only applies to the connections dialed by a writer created with NewDialingTcpWriter.
+func LocalAddr(addr *net.TCPAddr) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if addr == nil {
+			return errors.New("addr must not be nil")
+		}
+		w.dialer.LocalAddr = addr
+		return nil
+	})
+}
+
+// ReadBuffer sets the size of the receive buffer of the socket.
+func ReadBuffer(bytes int) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if bytes <= 0 {
+			return errors.New("bytes must be positive")
+		}
+		w.sockopts.readBuffer = bytes
+		return nil
+	})
+}
+
+// WriteBuffer sets the size of the send buffer of the socket.
+// A smaller buffer holds fewer bytes that are lost when the connection breaks unnoticed.
+func WriteBuffer(bytes int) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if bytes <= 0 {
+			return errors.New("bytes must be positive")
+		}
+		w.sockopts.writeBuffer = bytes
+		return nil
+	})
+}
+
+// NoDelay sets TCP_NODELAY. With false, small writes are coalesced by Nagle's algorithm.
+// Go enables it by default.
+func NoDelay(noDelay bool) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		w.sockopts.noDelay = &noDelay
+		return nil
+	})
+}
+
+// KeepAlivePeriod sets the period of the keepalive probes, which is used as idle time and interval.
+func KeepAlivePeriod(period time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if period <= 0 {
+			return errors.New("period must be positive")
+		}
+		w.sockopts.keepAlivePeriod = period
+		return nil
+	})
+}
+
+// KeepAliveIdle sets the idle time before the first keepalive probe is sent.
+// It overrides the period set by KeepAlivePeriod.
+func KeepAliveIdle(idle time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if idle < time.Second {
+			return errors.New("idle must be at least a second")
+		}
+		w.sockopts.keepAliveIdle = idle
+		return nil
+	})
+}
+
+// KeepAliveInterval sets the interval between keepalive probes.
+// It overrides the period set by KeepAlivePeriod.
+// It is not supported on all platforms.
+func KeepAliveInterval(interval time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if interval < time.Second {
+			return errors.New("interval must be at least a second")
+		}
+		if !keepAliveProbesSupported {
+			return errKeepAliveProbesUnsupported
+		}
+		w.sockopts.keepAliveInterval = interval
+		return nil
+	})
+}
+
+// KeepAliveCount sets the number of unanswered keepalive probes after which the connection is broken.
+// Together with the idle time and the interval, it defines how fast a silently broken connection is detected.
+// It is not supported on all platforms.
+func KeepAliveCount(count int) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if count <= 0 {
+			return errors.New("count must be positive")
+		}
+		if !keepAliveProbesSupported {
+			return errKeepAliveProbesUnsupported
+		}
+		w.sockopts.keepAliveCount = count
+		return nil
+	})
+}
+
+// UserTimeout sets TCP_USER_TIMEOUT: the kernel breaks the connection once written bytes
+// stay unacknowledged for timeout, so the next write or the monitor notices a silently dropped network.
+// It is only supported on Linux.
+func UserTimeout(timeout time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if timeout < time.Millisecond {
+			return errors.New("timeout must be at least a millisecond")
+		}
+		if !linuxSocketChecksSupported {
+			return errLinuxSocketChecksUnsupported
+		}
+		w.sockopts.userTimeout = timeout
+		return nil
+	})
+}
+
+// SendQueueCheck queries the bytes in the send queue of the socket (SIOCOUTQ)
+// and the bytes the peer acknowledged (TCP_INFO) every interval.
+// Once bytes stayed queued for stall without the peer acknowledging any, the peer is considered gone:
+// a write in progress is interrupted and the connection is replaced.
+// A silently dropped network is thus detected within stall plus interval,
+// as is a peer that stopped reading. A slow peer is not.
+// It is only supported on Linux 4.1 or later.
+func SendQueueCheck(interval, stall time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if interval <= 0 {
+			return errors.New("interval must be positive")
+		}
+		if stall < interval {
+			return errors.New("stall must be at least interval")
+		}
+		if !linuxSocketChecksSupported {
+			return errLinuxSocketChecksUnsupported
+		}
+		w.sendQueueInterval = interval
+		w.sendQueueStall = stall
+		return nil
+	})
+}
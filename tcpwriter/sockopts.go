@@ -0,0 +1,48 @@
+package tcpwriter
+
+import (
+	"net"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// sockopts are the socket options set on every new TCP connection.
+// Zero values keep the defaults of the platform.
+type sockopts struct {
+	readBuffer        int
+	writeBuffer       int
+	noDelay           *bool
+	keepAlivePeriod   time.Duration
+	keepAliveIdle     time.Duration
+	keepAliveInterval time.Duration
+	keepAliveCount    int
+	userTimeout       time.Duration
+}
+
+// apply sets the options on conn.
+func (o *sockopts) apply(conn *net.TCPConn) (err error) {
+	if o.readBuffer > 0 {
+		err = multierr.Append(err, conn.SetReadBuffer(o.readBuffer))
+	}
+	if o.writeBuffer > 0 {
+		err = multierr.Append(err, conn.SetWriteBuffer(o.writeBuffer))
+	}
+	if o.noDelay != nil {
+		err = multierr.Append(err, conn.SetNoDelay(*o.noDelay))
+	}
+	// aggressively set keepalive on the connection
+	// by default this still results in tcp_keepalive_probes * keepAlivePeriod before a broken conn is detected
+	// on linux tcp_keepalive_probes = 9
+	// see https://man7.org/linux/man-pages/man7/tcp.7.html
+	// and see https://groups.google.com/g/golang-nuts/c/IDnJDdM5Ek8 for a discussion on this topic
+	err = multierr.Append(err, conn.SetKeepAlive(true))
+	err = multierr.Append(err, conn.SetKeepAlivePeriod(o.keepAlivePeriod))
+	if o.keepAliveIdle > 0 || o.keepAliveInterval > 0 || o.keepAliveCount > 0 {
+		err = multierr.Append(err, setKeepAliveProbes(conn, o.keepAliveIdle, o.keepAliveInterval, o.keepAliveCount))
+	}
+	if o.userTimeout > 0 {
+		err = multierr.Append(err, setUserTimeout(conn, o.userTimeout))
+	}
+	return err
+}
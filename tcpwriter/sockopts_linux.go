@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package tcpwriter
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const keepAliveProbesSupported = true
+
+var errKeepAliveProbesUnsupported error
+
+// setKeepAliveProbes sets TCP_KEEPIDLE, TCP_KEEPINTVL and TCP_KEEPCNT, skipping zero values.
+func setKeepAliveProbes(conn *net.TCPConn, idle, interval time.Duration, count int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		set := func(opt, value int) {
+			if value > 0 && sockErr == nil {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt, value)
+			}
+		}
+		set(syscall.TCP_KEEPIDLE, int(idle/time.Second))
+		set(syscall.TCP_KEEPINTVL, int(interval/time.Second))
+		set(syscall.TCP_KEEPCNT, count)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+const linuxSocketChecksSupported = true
+
+var errLinuxSocketChecksUnsupported error
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, which the syscall package does not define.
+const tcpUserTimeout = 0x12
+
+// setUserTimeout sets TCP_USER_TIMEOUT in milliseconds.
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout/time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// tcpInfo is the struct tcp_info up to tcpi_bytes_acked, which syscall.TCPInfo lacks.
+type tcpInfo struct {
+	syscall.TCPInfo
+	pacingRate    uint64
+	maxPacingRate uint64
+	bytesAcked    uint64
+}
+
+// sendProgress returns the bytes in the send queue of conn, which are not sent yet or not acknowledged by the peer,
+// and the bytes the peer acknowledged in total.
+// SIOCOUTQ has the value of TIOCOUTQ. tcpi_bytes_acked requires Linux 4.1.
+func sendProgress(conn *net.TCPConn) (queued int, acked uint64, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var queued32 int32
+	var info tcpInfo
+	size := uint32(unsafe.Sizeof(info))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&queued32)))
+		if errno == 0 {
+			errno = getsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_INFO, unsafe.Pointer(&info), &size)
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	if size < uint32(unsafe.Sizeof(info)) {
+		return 0, 0, errAckedBytesUnsupported
+	}
+	return int(queued32), info.bytesAcked, nil
+}
+
+var errAckedBytesUnsupported = errors.New("the kernel does not report the acknowledged bytes")
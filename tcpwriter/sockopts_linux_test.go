@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package tcpwriter
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/delixfe/zap_ing/tcpwriter/test_support"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTcpWriter_LocalTcpServer_setsKeepAliveProbes(t *testing.T) {
+	server, err := test_support.NewLocalTcpServer(100)
+	require.NoError(t, err)
+	defer server.Close()
+	server.Run()
+
+	tcpWriter, err := NewTcpWriter(server.Dial,
+		KeepAliveIdle(time.Second*7),
+		KeepAliveInterval(time.Second*3),
+		KeepAliveCount(2),
+	)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	requireWrite(t, tcpWriter, []byte("message\n"))
+
+	raw, err := currentConn(t, tcpWriter).(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	sockopt := func(opt int) (value int) {
+		require.NoError(t, raw.Control(func(fd uintptr) {
+			value, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+			require.NoError(t, err)
+		}))
+		return value
+	}
+	assert.Equal(t, 7, sockopt(syscall.TCP_KEEPIDLE), "TCP_KEEPIDLE")
+	assert.Equal(t, 3, sockopt(syscall.TCP_KEEPINTVL), "TCP_KEEPINTVL")
+	assert.Equal(t, 2, sockopt(syscall.TCP_KEEPCNT), "TCP_KEEPCNT")
+}
+
+func TestTcpWriter_LocalTcpServer_setsUserTimeout(t *testing.T) {
+	server, err := test_support.NewLocalTcpServer(100)
+	require.NoError(t, err)
+	defer server.Close()
+	server.Run()
+
+	tcpWriter, err := NewTcpWriter(server.Dial, UserTimeout(time.Millisecond*2500))
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	requireWrite(t, tcpWriter, []byte("message\n"))
+
+	raw, err := currentConn(t, tcpWriter).(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var timeout int
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		timeout, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 2500, timeout, "TCP_USER_TIMEOUT in milliseconds")
+}
+
+func TestTcpWriter_LocalListener_SendQueueCheck_replacesStalledConnection(t *testing.T) {
+	ln, accepted := newNotReadingListener(t)
+	defer ln.Close()
+	tcpWriter, err := NewDialingTcpWriter("tcp", ln.Addr().String(),
+		// the write itself does not time out
+		WriteDeadline(time.Minute),
+		WriteBuffer(4096),
+		SendQueueCheck(time.Millisecond*20, time.Millisecond*200),
+		Backoff(func(attempt uint64) time.Duration { return time.Millisecond }),
+	)
+	require.NoError(t, err)
+
+	result := make(chan error, 1)
+	go func() {
+		// more than the socket buffers hold, so bytes stay in the send queue
+		_, err := tcpWriter.Write(make([]byte, 64<<20))
+		result <- err
+	}()
+
+	require.Eventually(t, func() bool { return accepted() >= 3 }, 5*time.Second, 10*time.Millisecond,
+		"the stalled connections are replaced")
+
+	assert.NoError(t, tcpWriter.Close())
+	assert.ErrorIs(t, <-result, ErrWriterClosed)
+}
+
+// newSlowReadingListener accepts connections and reads chunk bytes from them every interval.
+func newSlowReadingListener(t *testing.T, chunk int, interval time.Duration) (net.Listener, func() int32) {
+	ln, err := test_support.NewLocalListener("tcp")
+	require.NoError(t, err)
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, chunk)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					time.Sleep(interval)
+				}
+			}()
+		}
+	}()
+	return ln, func() int32 { return atomic.LoadInt32(&accepted) }
+}
+
+func TestTcpWriter_SlowReadingListener_SendQueueCheck_keepsConnection(t *testing.T) {
+	ln, accepted := newSlowReadingListener(t, 64<<10, time.Millisecond*20)
+	defer ln.Close()
+	tcpWriter, err := NewDialingTcpWriter("tcp", ln.Addr().String(),
+		WriteDeadline(time.Minute),
+		WriteBuffer(4096),
+		SendQueueCheck(time.Millisecond*20, time.Millisecond*200),
+	)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	// the send queue stays full while the peer reads for more than the stall time
+	requireWrite(t, tcpWriter, make([]byte, 2<<20))
+	assert.Equal(t, int32(1), accepted(), "the connection of a slow peer is not replaced")
+}
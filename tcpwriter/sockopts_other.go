@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package tcpwriter
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// the interval and the count of the keepalive probes are not portable
+const keepAliveProbesSupported = false
+
+var errKeepAliveProbesUnsupported = errors.New("keepalive interval and count are not supported on this platform")
+
+// setKeepAliveProbes sets the idle time as keepalive period.
+func setKeepAliveProbes(conn *net.TCPConn, idle, _ time.Duration, _ int) error {
+	if idle == 0 {
+		return nil
+	}
+	return conn.SetKeepAlivePeriod(idle)
+}
+
+// TCP_USER_TIMEOUT, SIOCOUTQ and TCP_INFO are Linux specific
+const linuxSocketChecksSupported = false
+
+var errLinuxSocketChecksUnsupported = errors.New("user timeout and send queue check are only supported on Linux")
+
+func setUserTimeout(_ *net.TCPConn, _ time.Duration) error {
+	return errLinuxSocketChecksUnsupported
+}
+
+func sendProgress(_ *net.TCPConn) (int, uint64, error) {
+	return 0, 0, errLinuxSocketChecksUnsupported
+}
@@ -1,14 +1,18 @@
 package tcpwriter
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"math"
 	"net"
+	"sync"
 	"time"
 )
 
 var (
 	ErrWriteTimeout = errors.New("write timed out")
+	ErrWriterClosed = errors.New("writer is closed")
 )
 
 type ConnProviderFn func() (net.Conn, error)
@@ -26,62 +30,225 @@ func DefaultBackoffFn(attempt uint64) time.Duration {
 	return time.Duration(backoff)
 }
 
-// TcpWriter is not thread-safe.
+// TcpWriter writes to a TCP connection and reconnects after errors.
+//
+// It is safe for concurrent use. A single sender loop owns the connection and its state:
+// Write and WriteBatch hand their bytes to the loop and wait for the result, so writes are serialized.
+// A monitor routine per connection detects a closed connection; it is stopped when the loop
+// disconnects. Close stops the loop and waits for the monitors.
+//
+// The exported fields must not be changed after the first write.
 type TcpWriter struct {
 	ConnProviderFn ConnProviderFn
-	conn           net.Conn
 	nowFn          func() time.Time
 	writeDeadLine  time.Duration
 	// instead of retry, report an error to caller
-	WriteTimeout time.Duration
-	BackoffFn    BackoffFn
+	WriteTimeout        time.Duration
+	BackoffFn           BackoffFn
+	monitorReadDeadline time.Duration
+	sendQueueInterval   time.Duration // 0 without SendQueueCheck
+	sendQueueStall      time.Duration
+	// dialer is used by the ConnProviderFn of NewDialingTcpWriter
+	dialer net.Dialer
+	// dialContext is used instead of ConnProviderFn if set, so dialing stops once its context is done
+	dialContext func(ctx context.Context) (net.Conn, error)
+	sockopts    sockopts
+	tlsOptions  tlsOptions
+	// tlsConfig is nil without TLS
+	tlsConfig *tls.Config
+
+	// requests are run by the sender loop
+	requests chan func()
+	// connStale is used by a monitor to report its conn as closed
+	connStale chan net.Conn
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{} // closed when the sender loop returned
+	monitors  sync.WaitGroup
+
+	// deadlineMu guards setting the write deadline of conn by the sender loop
+	// against the interruptions by Close and done contexts, which read conn
+	deadlineMu sync.Mutex
+
+	// owned by the sender loop, conn is only changed with deadlineMu held
+	state connState
+	conn  net.Conn
+	// monitorStop is closed to stop the monitor of conn
+	monitorStop chan struct{}
 	// retryAttempt we report errors for a given message
 	// after WriteTimeout but want to keep the BackoffFn for
 	// the next write attempt
 	retryAttempt uint64
-	// connStale is used by monitor to signal and by getConn to check if a new conn is required
-	connStale chan net.Conn
+	// buffers is reused by WriteBatch
+	buffers net.Buffers
+}
+
+// connState is the state of the connection of a TcpWriter.
+type connState int
+
+const (
+	// stateDisconnected has no connection; the next write connects.
+	stateDisconnected connState = iota
+	// stateConnected has a connection and its monitor.
+	stateConnected
+	// stateClosed is final; Close was called.
+	stateClosed
+)
+
+// NewTcpWriter creates a writer writing to the connections returned by connProviderFn.
+// The socket options are set on the connections that are a *net.TCPConn.
+// A write that is cancelled or closed while connProviderFn blocks does not wait for it;
+// the connection it returns afterwards is closed.
+// Close must be called to stop the sender loop.
+func NewTcpWriter(connProviderFn ConnProviderFn, options ...Option) (*TcpWriter, error) {
+	w, err := newTcpWriter(connProviderFn, "", options)
+	if err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// NewDialingTcpWriter creates a writer dialing address on network, which must be a TCP network.
+// The dial timeout and the local address apply. With TLS, the server name defaults to the host of address.
+func NewDialingTcpWriter(network, address string, options ...Option) (*TcpWriter, error) {
+	var w *TcpWriter
+	host, _, _ := net.SplitHostPort(address)
+	w, err := newTcpWriter(func() (net.Conn, error) {
+		return w.dialer.Dial(network, address)
+	}, host, options)
+	if err != nil {
+		return nil, err
+	}
+	w.dialContext = func(ctx context.Context) (net.Conn, error) {
+		return w.dialer.DialContext(ctx, network, address)
+	}
+	go w.run()
+	return w, nil
+}
+
+// newTcpWriter applies the options to a new writer. With TLS, the server name defaults to serverName.
+func newTcpWriter(connProviderFn ConnProviderFn, serverName string, options []Option) (*TcpWriter, error) {
+	if connProviderFn == nil {
+		return nil, errors.New("connProviderFn must not be nil")
+	}
+	w := &TcpWriter{
+		ConnProviderFn:      connProviderFn,
+		writeDeadLine:       time.Second,
+		WriteTimeout:        time.Minute * 5,
+		BackoffFn:           DefaultBackoffFn,
+		nowFn:               time.Now,
+		monitorReadDeadline: time.Second * 30,
+		sockopts: sockopts{
+			keepAlivePeriod: time.Second * 5,
+		},
+		tlsOptions: tlsOptions{
+			handshakeTimeout: time.Second * 10,
+		},
+		requests:  make(chan func()),
+		connStale: make(chan net.Conn),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	// keepalive is set up with the socket options
+	w.dialer.KeepAlive = -1
+	for _, option := range options {
+		if err := option.apply(w); err != nil {
+			return nil, err
+		}
+	}
+	w.tlsConfig = w.tlsOptions.config()
+	if w.tlsConfig != nil && w.tlsConfig.ServerName == "" {
+		w.tlsConfig.ServerName = serverName
+	}
+	if w.tlsConfig != nil && w.tlsConfig.ServerName == "" && !w.tlsConfig.InsecureSkipVerify {
+		return nil, errors.New("TLS requires a server name to verify the certificate against")
+	}
+	return w, nil
+}
+
+// run is the sender loop. It runs the requests and handles the stale connections until Close is called.
+func (w *TcpWriter) run() {
+	defer close(w.done)
+	for {
+		select {
+		case fn := <-w.requests:
+			fn()
+		case conn := <-w.connStale:
+			w.discardStale(conn)
+		case <-w.closing:
+			w.disconnect()
+			w.state = stateClosed
+			return
+		}
+	}
 }
 
-// TODO: implement functional options see https://github.com/uber-go/guide/blob/master/style.md#functional-options
-func NewTcpWriter(connProviderFn ConnProviderFn) (*TcpWriter, error) {
-	// TODO: see https://man7.org/linux/man-pages/man7/tcp.7.html
-	// tcp_keepalive_probes -- https://thenotexpert.com/golang-tcp-keepalive/
-	// check how to handle with tls connections
-	// TODO: config for timeout
-	return &TcpWriter{
-		ConnProviderFn: connProviderFn,
-		writeDeadLine:  time.Second,
-		WriteTimeout:   time.Minute * 5,
-		BackoffFn:      DefaultBackoffFn,
-		nowFn:          time.Now,
-		connStale:      make(chan net.Conn),
-	}, nil
+// do runs fn on the sender loop and waits until it returned.
+// It returns ErrWriterClosed if the writer is closed and the error of ctx if ctx is done before fn was run.
+func (w *TcpWriter) do(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	select {
+	case w.requests <- func() {
+		defer close(done)
+		fn()
+	}:
+	case <-w.closing:
+		return ErrWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
 }
 
 func (w *TcpWriter) Write(p []byte) (n int, err error) {
+	return w.WriteContext(context.Background(), p)
+}
 
-	// no retry after the deadline
-	deadline := w.nowFn().Add(w.WriteTimeout)
+// WriteContext writes p like Write, but stops as soon as ctx is done.
+// A write to the connection in progress is interrupted and the error of ctx is returned.
+// If ctx has a deadline before WriteTimeout, retrying ends at the deadline of ctx.
+func (w *TcpWriter) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	doErr := w.do(ctx, func() {
+		call := w.beginCall(ctx)
+		defer w.endCall(call)
+		n, err = w.writeRetrying(call, p)
+	})
+	if doErr != nil {
+		return 0, doErr
+	}
+	return
+}
 
+// WriteBatch writes ps with a single writev syscall where possible.
+// It returns the number of elements of ps written completely.
+// After an error, the write is retried starting with the first element not written completely.
+func (w *TcpWriter) WriteBatch(ps [][]byte) (n int, err error) {
+	ctx := context.Background()
+	doErr := w.do(ctx, func() {
+		call := w.beginCall(ctx)
+		defer w.endCall(call)
+		n, err = w.writeBatchRetrying(call, ps)
+	})
+	if doErr != nil {
+		return 0, doErr
+	}
+	return
+}
+
+func (w *TcpWriter) writeRetrying(call *writeCall, p []byte) (n int, err error) {
 	for {
 
-		n, err = w.write(p)
+		n, err = w.write(call, p)
 
 		if err != nil {
-			if nerr, ok := err.(net.Error); !ok || nerr.Timeout() || !nerr.Temporary() {
-				// permanent error or timeout so close the connection
-				w.closeConn()
+			if err = w.retryAfter(call, err); err == nil {
+				continue
 			}
-			// TODO: we block here knowing that the deadline for the current write
-			// may already be reached
-			w.retrySleep()
-			if w.nowFn().After(deadline) {
-				// explicitly set written bytes to 0 even if we wrote some bytes
-				// as very likely these never reached the target
-				return 0, ErrWriteTimeout
-			}
-			continue
+			// explicitly set written bytes to 0 even if we wrote some bytes
+			// as very likely these never reached the target
+			return 0, err
 		}
 
 		w.retryReset()
@@ -90,15 +257,73 @@ func (w *TcpWriter) Write(p []byte) (n int, err error) {
 	}
 }
 
-func (w *TcpWriter) write(p []byte) (total int, err error) {
-	if w.conn == nil {
-		w.conn, err = w.getConn()
+func (w *TcpWriter) writeBatchRetrying(call *writeCall, ps [][]byte) (n int, err error) {
+	for n < len(ps) {
+
+		var written int
+		written, err = w.writeBuffers(call, ps[n:])
+		n += written
+
+		if err != nil {
+			if err = w.retryAfter(call, err); err == nil {
+				continue
+			}
+			return n, err
+		}
+
+		w.retryReset()
 	}
-	if err != nil {
+	return n, nil
+}
+
+// retryAfter disconnects if err is permanent and sleeps for the backoff.
+// It returns the error to end the call with instead of retrying, if any.
+func (w *TcpWriter) retryAfter(call *writeCall, err error) error {
+	if nerr, ok := err.(net.Error); !ok || nerr.Timeout() || !nerr.Temporary() {
+		// permanent error or timeout so close the connection
+		w.disconnect()
+	}
+	if err = w.stopped(call); err != nil {
+		return err
+	}
+	return w.retrySleep(call)
+}
+
+// prepareConn connects if required and sets the write deadline.
+// The deadline is not set once the call is stopped, so an interruption is not overridden.
+func (w *TcpWriter) prepareConn(call *writeCall) (err error) {
+	if err = w.stopped(call); err != nil {
+		return
+	}
+	// a monitor might have reported the conn while the loop was busy
+	select {
+	case conn := <-w.connStale:
+		w.discardStale(conn)
+	default:
+	}
+	if w.state == stateDisconnected {
+		ctx, cancel := w.connectContext(call)
+		err = w.connect(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	if err = w.stopped(call); err != nil {
 		return
 	}
+	deadline := w.nowFn().Add(w.writeDeadLine)
+	if call.deadline.Before(deadline) {
+		deadline = call.deadline
+	}
+	return w.conn.SetWriteDeadline(deadline)
+}
 
-	err = w.conn.SetWriteDeadline(w.nowFn().Add(w.writeDeadLine))
+func (w *TcpWriter) write(call *writeCall, p []byte) (total int, err error) {
+	err = w.prepareConn(call)
 	if err != nil {
 		return
 	}
@@ -115,12 +340,47 @@ func (w *TcpWriter) write(p []byte) (total int, err error) {
 	return
 }
 
+// writeBuffers writes ps and returns the number of elements written completely.
+func (w *TcpWriter) writeBuffers(call *writeCall, ps [][]byte) (complete int, err error) {
+	err = w.prepareConn(call)
+	if err != nil {
+		return
+	}
+
+	// WriteTo consumes the buffers, so it gets a copy of ps
+	w.buffers = append(w.buffers[:0], ps...)
+	total, err := w.buffers.WriteTo(w.conn)
+	for i := range w.buffers {
+		w.buffers[i] = nil
+	}
+	w.buffers = w.buffers[:0]
+
+	for complete < len(ps) && total >= int64(len(ps[complete])) {
+		total -= int64(len(ps[complete]))
+		complete++
+	}
+	return
+}
+
 // TODO: consider move retry... in separate type
-func (w *TcpWriter) retrySleep() {
+// retrySleep sleeps for the backoff.
+// It does not sleep past the deadline of call but returns its deadline error right away.
+// It returns early if call is stopped meanwhile.
+func (w *TcpWriter) retrySleep(call *writeCall) error {
 	w.retryAttempt += 1
 	backoff := w.BackoffFn(w.retryAttempt)
+	if w.nowFn().Add(backoff).After(call.deadline) {
+		return call.deadlineErr
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
 	select {
-	case <-time.After(backoff):
+	case <-timer.C:
+		return nil
+	case <-call.ctx.Done():
+		return call.ctx.Err()
+	case <-w.closing:
+		return ErrWriterClosed
 	}
 }
 
@@ -128,68 +388,146 @@ func (w *TcpWriter) retryReset() {
 	w.retryAttempt = 0
 }
 
-func (w *TcpWriter) closeConn() {
-	if w.conn == nil {
-		return
-	}
-	_ = w.conn.Close()
-	w.conn = nil
+// Sync is a no-op as TcpWriter does not buffer.
+// It makes TcpWriter a zapcore.WriteSyncer, so zapcore.AddSync does not hide WriteBatch.
+func (w *TcpWriter) Sync() error {
+	return nil
 }
 
+// Close disconnects and stops the sender loop and the monitors.
+// A write in progress, including its dial and TLS handshake, is interrupted and returns ErrWriterClosed.
+// Writes after Close return ErrWriterClosed.
 func (w *TcpWriter) Close() (err error) {
-	w.closeConn()
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		w.interrupt()
+	})
+	<-w.done
+	w.monitors.Wait()
 	return
 }
 
-func (w *TcpWriter) getConn() (net.Conn, error) {
-	select {
-	case staleConn := <-w.connStale:
-		if staleConn == w.conn {
-			w.conn = nil
+// connectContext returns the context to connect for call with.
+// It is done once the context of call is done, the deadline of call passed or the writer is closed.
+func (w *TcpWriter) connectContext(call *writeCall) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithDeadline(call.ctx, call.deadline)
+	go func() {
+		select {
+		case <-w.closing:
+			cancel()
+		case <-ctx.Done():
 		}
-	default:
+	}()
+	return ctx, cancel
+}
+
+// dial returns a new connection, or the error of ctx once it is done.
+// A ConnProviderFn still running then is left behind; the connection it returns is closed.
+func (w *TcpWriter) dial(ctx context.Context) (net.Conn, error) {
+	if w.dialContext != nil {
+		return w.dialContext(ctx)
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
 	}
-	if w.conn != nil {
-		return w.conn, nil
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := w.ConnProviderFn()
+		result <- dialed{conn, err}
+	}()
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
 	}
-	conn, err := w.ConnProviderFn()
+}
+
+// connect transitions from stateDisconnected to stateConnected.
+// Dialing and the TLS handshake stop once ctx is done.
+func (w *TcpWriter) connect(ctx context.Context) error {
+	conn, err := w.dial(ctx)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	tcpConn, isTCP := conn.(*net.TCPConn)
+	if isTCP {
+		if err = w.sockopts.apply(tcpConn); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+	if w.tlsConfig != nil {
+		if conn, err = w.handshake(ctx, conn); err != nil {
+			return err
+		}
 	}
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		keepAlivePeriod := time.Second * 5
-		// aggressively set keepalive on the connection
-		// this still results in tcp_keepalive_probes * keepAlivePeriod before a broken conn is detected
-		// on linux tcp_keepalive_probes = 9
-		// see https://man7.org/linux/man-pages/man7/tcp.7.html
-		// and see https://groups.google.com/g/golang-nuts/c/IDnJDdM5Ek8 for a discussion on this topic
-		// TODO: consider using https://pkg.go.dev/github.com/mikioh/tcp to set tcp_keepalive_probes
-		tcpConn.SetKeepAlivePeriod(keepAlivePeriod)
-		tcpConn.SetKeepAlive(true)
+	w.deadlineMu.Lock()
+	w.conn = conn
+	w.deadlineMu.Unlock()
+	w.monitorStop = make(chan struct{})
+	w.monitors.Add(1)
+	go w.monitor(conn, w.monitorStop)
+	if isTCP && w.sendQueueInterval > 0 {
+		w.monitors.Add(1)
+		go w.checkSendQueue(tcpConn, conn, w.monitorStop)
 	}
-	go w.monitor(conn)
-	return conn, nil
+	w.state = stateConnected
+	return nil
+}
+
+// disconnect transitions from stateConnected to stateDisconnected.
+// The monitor is stopped before the conn is closed, so it does not report the conn.
+func (w *TcpWriter) disconnect() {
+	if w.state != stateConnected {
+		return
+	}
+	close(w.monitorStop)
+	_ = w.conn.Close()
+	w.deadlineMu.Lock()
+	w.conn = nil
+	w.deadlineMu.Unlock()
+	w.monitorStop = nil
+	w.state = stateDisconnected
 }
 
+// discardStale disconnects if conn is the current connection.
+// Otherwise conn was replaced already.
+func (w *TcpWriter) discardStale(conn net.Conn) {
+	if w.state == stateConnected && conn == w.conn {
+		w.disconnect()
+	}
+}
+
+// monitorPollInterval is the pause between the reads of the monitor.
+const monitorPollInterval = time.Second
+
 // monitor continuously tries to read from the connection to detect socket close.
 // This is needed because TCP target uses a write only socket and Linux systems
 // take a long time to detect a loss of connectivity on a socket when only writing;
 // the writes simply fail without an error returned.
+// It returns once stop is closed, at the latest when its read returns after conn was closed.
+// A silently dropped network is only noticed with UserTimeout or SendQueueCheck.
 // Copied from https://github.com/mattermost/logr/blob/c356d52ac2edba5368558635e670e8d0fc386672/targets/tcp.go
-// TODO: consider using https://groups.google.com/g/golang-nuts/c/IDnJDdM5Ek8 `SIOCOUTQ`
-// to query the number of bytes in the socket send queue
-func (w *TcpWriter) monitor(conn net.Conn) {
+func (w *TcpWriter) monitor(conn net.Conn, stop <-chan struct{}) {
+	defer w.monitors.Done()
 	buf := make([]byte, 1)
 	for {
-		if conn != w.conn {
+		select {
+		case <-stop:
 			// the monitored conn is not used anymore
 			return
-		}
-		select {
-		case <-time.After(1 * time.Second):
+		case <-time.After(monitorPollInterval):
 		}
 
-		err := conn.SetReadDeadline(w.nowFn().Add(time.Second * 30))
+		// time.Now instead of nowFn, which is owned by the sender loop
+		err := conn.SetReadDeadline(time.Now().Add(w.monitorReadDeadline))
 		if err != nil {
 			continue
 		}
@@ -202,7 +540,54 @@ func (w *TcpWriter) monitor(conn net.Conn) {
 		}
 
 		// Any other error forces a reconnect.
-		w.connStale <- conn
+		w.reportStale(conn, stop)
 		return
 	}
 }
+
+// reportStale reports conn to the sender loop unless stop is closed.
+func (w *TcpWriter) reportStale(conn net.Conn, stop <-chan struct{}) {
+	select {
+	case w.connStale <- conn:
+	case <-stop:
+	}
+}
+
+// checkSendQueue queries the bytes in the send queue of tcpConn and the bytes the peer acknowledged every interval.
+// Once bytes stayed queued for the stall time without the peer acknowledging any,
+// the peer is considered gone: a write in progress to conn is interrupted and conn is reported as stale.
+// A slow peer keeps conn, even if the writes keep its send queue full.
+// It returns once stop is closed.
+func (w *TcpWriter) checkSendQueue(tcpConn *net.TCPConn, conn net.Conn, stop <-chan struct{}) {
+	defer w.monitors.Done()
+	ticker := time.NewTicker(w.sendQueueInterval)
+	defer ticker.Stop()
+	var lastAcked uint64
+	var stalledSince time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		queued, acked, err := sendProgress(tcpConn)
+		if err != nil {
+			// closed, which the monitor notices
+			continue
+		}
+		now := time.Now()
+		switch {
+		case queued == 0:
+			stalledSince = time.Time{}
+		case stalledSince.IsZero() || acked != lastAcked:
+			// the peer makes progress
+			stalledSince = now
+		case now.Sub(stalledSince) >= w.sendQueueStall:
+			w.interruptConn(conn)
+			w.reportStale(conn, stop)
+			return
+		}
+		lastAcked = acked
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package tcpwriter
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newBlackholeAddress returns the address of a listener whose accept queue is full,
+// so the SYN of a further connection is dropped and dialing blocks.
+func newBlackholeAddress(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = syscall.Close(fd) })
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	require.NoError(t, syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	require.NoError(t, err)
+	address := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	// a backlog of 0 admits a single connection
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return address
+}
+
+func TestTcpWriter_BlackholeAddress_interruptsBlockedDial(t *testing.T) {
+	testInterrupts(t, func(t *testing.T) *TcpWriter {
+		tcpWriter, err := NewDialingTcpWriter("tcp", newBlackholeAddress(t), DialTimeout(time.Minute), WriteTimeout(time.Minute))
+		require.NoError(t, err)
+		return tcpWriter
+	}, []byte("message\n"))
+}
@@ -1,11 +1,14 @@
 package tcpwriter
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,7 +25,7 @@ func TestTcpWriter_LocalTcpServer_Write(t *testing.T) {
 
 	tcpWriter, err := NewTcpWriter(server.Dial)
 	require.NoError(t, err)
-	defer assert.NoError(t, tcpWriter.Close())
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
 
 	message := []byte("message\n")
 	count := 50
@@ -48,7 +51,7 @@ func TestTcpWriter_LocalTcpServer_ReconnectsAfterServerClose(t *testing.T) {
 
 	tcpWriter, err := NewTcpWriter(server.Dial)
 	require.NoError(t, err)
-	defer assert.NoError(t, tcpWriter.Close())
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
 
 	message := []byte("message\n")
 
@@ -107,6 +110,207 @@ func TestTcpWriter_MockConn_AfterWriteTimeout_ReturnErrWriteTimeout(t *testing.T
 
 }
 
+func TestTcpWriter_LocalTcpServer_WriteBatch(t *testing.T) {
+
+	server, err := test_support.NewLocalTcpServer(100)
+	require.NoError(t, err)
+	defer server.Close()
+	server.Run()
+
+	tcpWriter, err := NewTcpWriter(server.Dial)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	batch := [][]byte{[]byte("one\n"), []byte("two\n"), []byte("three\n")}
+	n, err := tcpWriter.WriteBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, len(batch), n)
+
+	for _, message := range batch {
+		requireRead(t, server, message)
+	}
+}
+
+func TestTcpWriter_MockConn_WriteBatch_retriesIncompleteElements(t *testing.T) {
+	mockConnection := &test_support.MockConnection{}
+	var connProviderFn ConnProviderFn = func() (net.Conn, error) {
+		return mockConnection, nil
+	}
+	var written []string
+	failed := false
+	mockConnection.WriteFn = func(b []byte) (int, error) {
+		if string(b) == "two" && !failed {
+			// the second element is written partially
+			failed = true
+			written = append(written, "t")
+			return 1, errors.New("some error")
+		}
+		written = append(written, string(b))
+		return len(b), nil
+	}
+	tcpWriter, err := NewTcpWriter(connProviderFn)
+	require.NoError(t, err)
+	tcpWriter.BackoffFn = func(attempt uint64) time.Duration {
+		return time.Millisecond
+	}
+
+	n, err := tcpWriter.WriteBatch([][]byte{[]byte("one"), []byte("two"), []byte("three")})
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{"one", "t", "two", "three"}, written, "retried from the incomplete element")
+}
+
+func TestNewTcpWriter_options(t *testing.T) {
+	dial := func() (net.Conn, error) { return nil, errors.New("not dialed") }
+	tests := []struct {
+		name    string
+		option  Option
+		wantErr bool
+		assert  func(w *TcpWriter) bool
+	}{
+		{name: "write deadline", option: WriteDeadline(time.Minute), assert: func(w *TcpWriter) bool { return w.writeDeadLine == time.Minute }},
+		{name: "write deadline zero", option: WriteDeadline(0), wantErr: true},
+		{name: "write timeout", option: WriteTimeout(time.Minute), assert: func(w *TcpWriter) bool { return w.WriteTimeout == time.Minute }},
+		{name: "write timeout zero", option: WriteTimeout(0), wantErr: true},
+		{name: "backoff nil", option: Backoff(nil), wantErr: true},
+		{name: "monitor read deadline", option: MonitorReadDeadline(time.Minute), assert: func(w *TcpWriter) bool { return w.monitorReadDeadline == time.Minute }},
+		{name: "monitor read deadline zero", option: MonitorReadDeadline(0), wantErr: true},
+		{name: "dial timeout", option: DialTimeout(time.Minute), assert: func(w *TcpWriter) bool { return w.dialer.Timeout == time.Minute }},
+		{name: "dial timeout zero", option: DialTimeout(0), wantErr: true},
+		{name: "local addr nil", option: LocalAddr(nil), wantErr: true},
+		{name: "read buffer zero", option: ReadBuffer(0), wantErr: true},
+		{name: "write buffer", option: WriteBuffer(4096), assert: func(w *TcpWriter) bool { return w.sockopts.writeBuffer == 4096 }},
+		{name: "no delay", option: NoDelay(false), assert: func(w *TcpWriter) bool { return !*w.sockopts.noDelay }},
+		{name: "keepalive period zero", option: KeepAlivePeriod(0), wantErr: true},
+		{name: "keepalive idle below a second", option: KeepAliveIdle(time.Millisecond), wantErr: true},
+		{name: "keepalive interval below a second", option: KeepAliveInterval(time.Millisecond), wantErr: true},
+		{name: "keepalive count zero", option: KeepAliveCount(0), wantErr: true},
+		{name: "user timeout below a millisecond", option: UserTimeout(time.Microsecond), wantErr: true},
+		{name: "send queue check stall below interval", option: SendQueueCheck(time.Second, time.Millisecond), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewTcpWriter(dial, tt.option)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, tt.assert(w))
+		})
+	}
+}
+
+func TestNewDialingTcpWriter_LocalTcpServer_Write(t *testing.T) {
+	server, err := test_support.NewLocalTcpServer(100)
+	require.NoError(t, err)
+	defer server.Close()
+	server.Run()
+
+	tcpWriter, err := NewDialingTcpWriter("tcp", server.Address(),
+		DialTimeout(time.Second),
+		LocalAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}),
+		WriteBuffer(8192),
+		ReadBuffer(8192),
+		NoDelay(false),
+		KeepAlivePeriod(time.Second*10),
+	)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	message := []byte("message\n")
+	requireWrite(t, tcpWriter, message)
+	requireRead(t, server, message)
+	assert.Equal(t, "127.0.0.1", currentConn(t, tcpWriter).LocalAddr().(*net.TCPAddr).IP.String())
+}
+
+func TestTcpWriter_LocalTcpServer_concurrentWrites(t *testing.T) {
+	const writers, writes = 8, 50
+	server, err := test_support.NewLocalTcpServer(writers * writes)
+	require.NoError(t, err)
+	defer server.Close()
+	server.Run()
+
+	tcpWriter, err := NewTcpWriter(server.Dial)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				if j%2 == 0 {
+					requireWrite(t, tcpWriter, []byte(fmt.Sprintf("write %d %d\n", i, j)))
+				} else {
+					_, err := tcpWriter.WriteBatch([][]byte{[]byte(fmt.Sprintf("batch %d %d\n", i, j))})
+					assert.NoError(t, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	received := make(map[string]bool)
+	for i := 0; i < writers*writes; i++ {
+		line, err := server.WaitForOneLineWithTimeout(10)
+		require.NoError(t, err)
+		received[string(line)] = true
+	}
+	assert.Len(t, received, writers*writes)
+	assert.EqualValues(t, 1, server.TotalConnCount(), "expected only one connection to the server")
+
+	require.NoError(t, tcpWriter.Close())
+	_, err = tcpWriter.Write([]byte("after close\n"))
+	assert.ErrorIs(t, err, ErrWriterClosed)
+	_, err = tcpWriter.WriteBatch([][]byte{[]byte("after close\n")})
+	assert.ErrorIs(t, err, ErrWriterClosed)
+}
+
+func TestTcpWriter_LocalTcpServer_stopsMonitorOfEveryConnection(t *testing.T) {
+	server, err := test_support.NewLocalTcpServer(100)
+	require.NoError(t, err)
+	defer server.Close()
+	server.Run()
+
+	tcpWriter, err := NewTcpWriter(server.Dial)
+	require.NoError(t, err)
+
+	message := []byte("message\n")
+	requireWrite(t, tcpWriter, message)
+
+	// replaced by the writer
+	require.NoError(t, tcpWriter.do(context.Background(), tcpWriter.disconnect))
+	requireWrite(t, tcpWriter, message)
+
+	// detected by the monitor
+	require.Eventually(t, func() bool { return server.TotalRecLinesCount() == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, server.CloseAllClientConnections())
+	require.Eventually(t, func() bool { return currentConn(t, tcpWriter) == nil }, 5*time.Second, 10*time.Millisecond,
+		"the monitor reports the closed connection")
+	requireWrite(t, tcpWriter, message)
+	require.Eventually(t, func() bool { return server.TotalRecLinesCount() == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 3, server.TotalConnCount())
+
+	// Close waits for the monitors
+	closed := make(chan struct{})
+	go func() {
+		assert.NoError(t, tcpWriter.Close())
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return, a monitor is still running")
+	}
+}
+
+// currentConn returns the connection of w from its sender loop.
+func currentConn(t *testing.T, w *TcpWriter) (conn net.Conn) {
+	require.NoError(t, w.do(context.Background(), func() { conn = w.conn }))
+	return conn
+}
+
 func requireWrite(t *testing.T, w io.Writer, data []byte) {
 	r := require.New(t)
 
@@ -147,3 +351,143 @@ func TestDefaultBackoffFn(t *testing.T) {
 		})
 	}
 }
+
+func newFailingMockConnWriter(t *testing.T, options ...Option) *TcpWriter {
+	mockConnection := &test_support.MockConnection{
+		WriteFn: func(b []byte) (int, error) {
+			return 0, errors.New("some error")
+		},
+	}
+	tcpWriter, err := NewTcpWriter(func() (net.Conn, error) {
+		return mockConnection, nil
+	}, append([]Option{Backoff(func(attempt uint64) time.Duration {
+		return time.Hour
+	})}, options...)...)
+	require.NoError(t, err)
+	return tcpWriter
+}
+
+func TestTcpWriter_MockConn_WriteContext_cancelledDuringBackoff(t *testing.T) {
+	tcpWriter := newFailingMockConnWriter(t, WriteTimeout(time.Hour*2))
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+	start := time.Now()
+	n, err := tcpWriter.WriteContext(ctx, []byte("message"))
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, n)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "returned while sleeping for the backoff")
+}
+
+func TestTcpWriter_MockConn_doesNotSleepPastDeadline(t *testing.T) {
+	tcpWriter := newFailingMockConnWriter(t, WriteTimeout(time.Minute))
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	start := time.Now()
+	_, err := tcpWriter.Write([]byte("message"))
+	assert.ErrorIs(t, err, ErrWriteTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err = tcpWriter.WriteContext(ctx, []byte("message"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "the backoff of an hour ends after the deadline")
+}
+
+// newNotReadingListener accepts connections but never reads from them,
+// so writes block once the socket buffers are full.
+// It returns a function counting the accepted connections.
+func newNotReadingListener(t *testing.T) (net.Listener, func() int32) {
+	ln, err := test_support.NewLocalListener("tcp")
+	require.NoError(t, err)
+	var accepted int32
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conns = append(conns, conn)
+		}
+	}()
+	return ln, func() int32 { return atomic.LoadInt32(&accepted) }
+}
+
+func TestTcpWriter_LocalListener_interruptsBlockedWrite(t *testing.T) {
+	testInterrupts(t, func(t *testing.T) *TcpWriter {
+		ln, _ := newNotReadingListener(t)
+		t.Cleanup(func() { _ = ln.Close() })
+		tcpWriter, err := NewDialingTcpWriter("tcp", ln.Addr().String(), WriteDeadline(time.Minute), WriteBuffer(4096))
+		require.NoError(t, err)
+		return tcpWriter
+	}, make([]byte, 64<<20))
+}
+
+func TestTcpWriter_LocalListener_interruptsBlockedHandshake(t *testing.T) {
+	testInterrupts(t, func(t *testing.T) *TcpWriter {
+		// the server never answers the handshake
+		ln, _ := newNotReadingListener(t)
+		t.Cleanup(func() { _ = ln.Close() })
+		tcpWriter, err := NewDialingTcpWriter("tcp", ln.Addr().String(), TLSServerName("localhost"), TLSHandshakeTimeout(time.Minute), WriteTimeout(time.Minute))
+		require.NoError(t, err)
+		return tcpWriter
+	}, []byte("message\n"))
+}
+
+func TestTcpWriter_blockingConnProvider_interruptsBlockedConnect(t *testing.T) {
+	testInterrupts(t, func(t *testing.T) *TcpWriter {
+		unblock := make(chan struct{})
+		t.Cleanup(func() { close(unblock) })
+		tcpWriter, err := NewTcpWriter(func() (net.Conn, error) {
+			<-unblock
+			return nil, errors.New("not connected")
+		}, WriteTimeout(time.Minute))
+		require.NoError(t, err)
+		return tcpWriter
+	}, []byte("message\n"))
+}
+
+// testInterrupts writes p with the writer returned by newWriter, which must block,
+// and asserts that cancelling the context of the write and Close interrupt it.
+func testInterrupts(t *testing.T, newWriter func(t *testing.T) *TcpWriter, p []byte) {
+	tests := []struct {
+		name      string
+		interrupt func(w *TcpWriter, cancel context.CancelFunc)
+		wantErr   error
+	}{
+		{name: "cancel", interrupt: func(_ *TcpWriter, cancel context.CancelFunc) { cancel() }, wantErr: context.Canceled},
+		{name: "close", interrupt: func(w *TcpWriter, _ context.CancelFunc) { assert.NoError(t, w.Close()) }, wantErr: ErrWriterClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcpWriter := newWriter(t)
+			defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := make(chan error, 1)
+			go func() {
+				_, err := tcpWriter.WriteContext(ctx, p)
+				result <- err
+			}()
+			time.Sleep(time.Millisecond * 100)
+			tt.interrupt(tcpWriter, cancel)
+
+			select {
+			case err := <-result:
+				assert.ErrorIs(t, err, tt.wantErr)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the blocked write was not interrupted")
+			}
+		})
+	}
+}
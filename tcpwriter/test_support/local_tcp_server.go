@@ -80,11 +80,13 @@ func (s *localTcpServer) Address() string {
 }
 
 func (s *localTcpServer) TotalConnCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.totalConnCount
 }
 
 func (s *localTcpServer) TotalRecLinesCount() uint32 {
-	return s.totalRecLinesCount
+	return atomic.LoadUint32(&s.totalRecLinesCount)
 }
 
 func (s *localTcpServer) Dial() (net.Conn, error) {
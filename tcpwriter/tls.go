@@ -0,0 +1,185 @@
+package tcpwriter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsOptions collect the TLS options until NewTcpWriter builds the tls.Config from them,
+// so they can be passed in any order.
+type tlsOptions struct {
+	enabled          bool
+	base             *tls.Config
+	serverName       string
+	rootCAs          *x509.CertPool
+	clientCert       *certReloader
+	handshakeTimeout time.Duration
+}
+
+// config returns the tls.Config for the connections or nil if TLS is not enabled.
+func (o *tlsOptions) config() *tls.Config {
+	if !o.enabled {
+		return nil
+	}
+	config := &tls.Config{}
+	if o.base != nil {
+		config = o.base.Clone()
+	}
+	if o.serverName != "" {
+		config.ServerName = o.serverName
+	}
+	if o.rootCAs != nil {
+		config.RootCAs = o.rootCAs
+	}
+	if o.clientCert != nil {
+		config.Certificates = nil
+		config.GetClientCertificate = o.clientCert.getClientCertificate
+	}
+	return config
+}
+
+// TLSConfig enables TLS with a clone of config.
+// The other TLS options override the corresponding fields of config.
+func TLSConfig(config *tls.Config) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if config == nil {
+			return errors.New("config must not be nil")
+		}
+		w.tlsOptions.enabled = true
+		w.tlsOptions.base = config
+		return nil
+	})
+}
+
+// TLSServerName enables TLS and sets the name the certificate of the server is verified against.
+// NewDialingTcpWriter defaults it to the host of the address; NewTcpWriter requires it,
+// unless the verification is disabled with TLSConfig.
+func TLSServerName(serverName string) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if serverName == "" {
+			return errors.New("serverName must not be empty")
+		}
+		w.tlsOptions.enabled = true
+		w.tlsOptions.serverName = serverName
+		return nil
+	})
+}
+
+// TLSRootCAs enables TLS and sets the certificate authorities the certificate of the server is verified with.
+// Without it, the system roots are used.
+func TLSRootCAs(rootCAs *x509.CertPool) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if rootCAs == nil {
+			return errors.New("rootCAs must not be nil")
+		}
+		w.tlsOptions.enabled = true
+		w.tlsOptions.rootCAs = rootCAs
+		return nil
+	})
+}
+
+// TLSClientCertificate enables mutual TLS with the PEM encoded certificate and key in certFile and keyFile.
+// The files are loaded right away and reloaded on a new connection once they were modified,
+// so a rotated certificate is used without a restart.
+// If the modified files cannot be loaded, e.g. as only one of them was replaced yet,
+// the previous certificate is used until they can.
+func TLSClientCertificate(certFile, keyFile string) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		clientCert, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		w.tlsOptions.enabled = true
+		w.tlsOptions.clientCert = clientCert
+		return nil
+	})
+}
+
+// TLSHandshakeTimeout limits the time of the TLS handshake.
+func TLSHandshakeTimeout(timeout time.Duration) Option {
+	return optionFunc(func(w *TcpWriter) error {
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		w.tlsOptions.handshakeTimeout = timeout
+		return nil
+	})
+}
+
+// handshake wraps conn in a TLS client connection and runs the handshake until ctx is done.
+// conn is closed on error.
+// Keepalive is set on the TCP connection before and reading from the TLS connection
+// reads from the TCP connection, so the monitor still detects a closed connection.
+func (w *TcpWriter) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Client(conn, w.tlsConfig)
+	err := conn.SetDeadline(w.nowFn().Add(w.tlsOptions.handshakeTimeout))
+	if err == nil {
+		err = tlsConn.HandshakeContext(ctx)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// certReloader reloads a certificate and its key once their files were modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the files if they were modified since they were loaded last.
+// On error, the previous certificate is kept and the files are loaded again the next time.
+func (r *certReloader) reload() error {
+	certStat, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certStat.ModTime().Equal(r.certMod) && keyStat.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certMod = certStat.ModTime()
+	r.keyMod = keyStat.ModTime()
+	return nil
+}
+
+// getClientCertificate is called by the TLS handshake.
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the previous certificate is better than none
+	_ = r.reload()
+	return r.cert, nil
+}
@@ -0,0 +1,219 @@
+package tcpwriter
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/delixfe/zap_ing/tcpwriter/test_support"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns the PEM encoded certificate and key for commonName, valid for localhost.
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFiles writes the certificate and key of commonName with the modification time mod.
+func (ca *testCA) writeFiles(t *testing.T, certFile, keyFile, commonName string, serial int64, mod time.Time) {
+	certPEM, keyPEM := ca.issue(t, commonName, serial)
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	require.NoError(t, os.Chtimes(keyFile, mod, mod))
+}
+
+type tlsLine struct {
+	client string // common name of the client certificate
+	line   string
+}
+
+// newTLSServer accepts TLS connections requiring a client certificate issued by ca
+// and sends the received lines to the returned channel.
+func newTLSServer(t *testing.T, ca *testCA) (net.Listener, <-chan tlsLine) {
+	certPEM, keyPEM := ca.issue(t, "server", 100)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	ln, err := test_support.NewLocalListener("tcp")
+	require.NoError(t, err)
+	ln = tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	lines := make(chan tlsLine, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+				client := tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					lines <- tlsLine{client: client, line: line}
+				}
+			}()
+		}
+	}()
+	return ln, lines
+}
+
+func requireTLSLine(t *testing.T, lines <-chan tlsLine, expected tlsLine) {
+	select {
+	case line := <-lines:
+		require.Equal(t, expected, line)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no line received")
+	}
+}
+
+func TestTcpWriter_TLS_reloadsRotatedClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	ln, lines := newTLSServer(t, ca)
+	defer ln.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	rotated := time.Now().Add(-time.Minute)
+	ca.writeFiles(t, certFile, keyFile, "client 1", 2, rotated)
+
+	tcpWriter, err := NewDialingTcpWriter("tcp", net.JoinHostPort("localhost", port),
+		TLSRootCAs(ca.pool),
+		TLSClientCertificate(certFile, keyFile),
+		KeepAliveIdle(time.Second*7),
+	)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	requireWrite(t, tcpWriter, []byte("one\n"))
+	requireTLSLine(t, lines, tlsLine{client: "client 1", line: "one\n"})
+
+	ca.writeFiles(t, certFile, keyFile, "client 2", 3, rotated.Add(time.Second))
+	// the connection in use keeps the previous certificate
+	requireWrite(t, tcpWriter, []byte("two\n"))
+	requireTLSLine(t, lines, tlsLine{client: "client 1", line: "two\n"})
+
+	require.NoError(t, tcpWriter.do(context.Background(), tcpWriter.disconnect))
+	requireWrite(t, tcpWriter, []byte("three\n"))
+	requireTLSLine(t, lines, tlsLine{client: "client 2", line: "three\n"})
+}
+
+func TestTcpWriter_TLS_unknownServerName_failsHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	ln, _ := newTLSServer(t, ca)
+	defer ln.Close()
+
+	tcpWriter, err := NewDialingTcpWriter("tcp", ln.Addr().String(),
+		TLSRootCAs(ca.pool),
+		TLSServerName("unknown"),
+	)
+	require.NoError(t, err)
+
+	defer func() { assert.NoError(t, tcpWriter.Close()) }()
+
+	require.NoError(t, tcpWriter.do(context.Background(), func() { err = tcpWriter.connect(context.Background()) }))
+	var hostnameErr x509.HostnameError
+	assert.ErrorAs(t, err, &hostnameErr)
+}
+
+func TestNewTcpWriter_TLS_options(t *testing.T) {
+	dial := func() (net.Conn, error) { return nil, nil }
+
+	w, err := NewTcpWriter(dial)
+	require.NoError(t, err)
+	assert.Nil(t, w.tlsConfig, "TLS is not enabled by default")
+
+	pool := x509.NewCertPool()
+	w, err = NewTcpWriter(dial, TLSServerName("name"), TLSConfig(&tls.Config{ServerName: "base", MinVersion: tls.VersionTLS13}), TLSRootCAs(pool))
+	require.NoError(t, err)
+	assert.Equal(t, "name", w.tlsConfig.ServerName, "options override the config")
+	assert.Equal(t, uint16(tls.VersionTLS13), w.tlsConfig.MinVersion)
+	assert.Same(t, pool, w.tlsConfig.RootCAs)
+
+	_, err = NewTcpWriter(dial, TLSServerName("name"), TLSClientCertificate("missing.crt", "missing.key"))
+	assert.Error(t, err)
+
+	_, err = NewTcpWriter(dial, TLSRootCAs(pool))
+	assert.Error(t, err, "the certificate of the server cannot be verified without a server name")
+
+	w, err = NewTcpWriter(dial, TLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	require.NoError(t, err)
+	assert.Empty(t, w.tlsConfig.ServerName)
+
+	w, err = NewDialingTcpWriter("tcp", "localhost:1", TLSRootCAs(pool))
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, "localhost", w.tlsConfig.ServerName, "defaults to the host of the address")
+
+	_, err = NewDialingTcpWriter("tcp", "localhost", TLSRootCAs(pool))
+	assert.Error(t, err, "the address has no host to default the server name to")
+}
@@ -0,0 +1,97 @@
+package tcpwriter
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// writeCall is a Write, WriteContext or WriteBatch run by the sender loop.
+type writeCall struct {
+	ctx context.Context
+	// deadline ends retrying with deadlineErr
+	deadline    time.Time
+	deadlineErr error
+	// ended is closed by endCall; nil if ctx is never done
+	ended chan struct{}
+	// done is set by endCall, guarded by deadlineMu
+	done bool
+}
+
+// aLongTimeAgo is a deadline in the past, which interrupts a write in progress.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// beginCall starts a call. Retrying ends after WriteTimeout or at the deadline of ctx, whichever is earlier.
+// Once ctx is done, a write in progress is interrupted.
+func (w *TcpWriter) beginCall(ctx context.Context) *writeCall {
+	call := &writeCall{
+		ctx:         ctx,
+		deadline:    w.nowFn().Add(w.WriteTimeout),
+		deadlineErr: ErrWriteTimeout,
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(call.deadline) {
+		call.deadline = deadline
+		call.deadlineErr = context.DeadlineExceeded
+	}
+	if ctx.Done() != nil {
+		call.ended = make(chan struct{})
+		go w.interruptOnDone(call)
+	}
+	return call
+}
+
+func (w *TcpWriter) endCall(call *writeCall) {
+	w.deadlineMu.Lock()
+	call.done = true
+	w.deadlineMu.Unlock()
+	if call.ended != nil {
+		close(call.ended)
+	}
+}
+
+// interruptOnDone interrupts the write of call in progress once its context is done.
+func (w *TcpWriter) interruptOnDone(call *writeCall) {
+	select {
+	case <-call.ctx.Done():
+	case <-call.ended:
+		return
+	}
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	if !call.done {
+		// a later call sets its own deadline
+		w.interruptLocked()
+	}
+}
+
+// interrupt interrupts a write in progress.
+func (w *TcpWriter) interrupt() {
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	w.interruptLocked()
+}
+
+// interruptConn interrupts a write in progress if conn is still the connection in use.
+func (w *TcpWriter) interruptConn(conn net.Conn) {
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	if w.conn == conn {
+		w.interruptLocked()
+	}
+}
+
+func (w *TcpWriter) interruptLocked() {
+	if w.conn != nil {
+		_ = w.conn.SetWriteDeadline(aLongTimeAgo)
+	}
+}
+
+// stopped returns the error to end call with if the writer is closed or the context of call is done.
+func (w *TcpWriter) stopped(call *writeCall) error {
+	select {
+	case <-w.closing:
+		return ErrWriterClosed
+	default:
+	}
+	return call.ctx.Err()
+}